@@ -0,0 +1,133 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ApkRepositoriesPath = "/etc/apk/repositories"
+	ApkKeysDir          = "/etc/apk/keys"
+	// Installed in addition to the configured packages
+	AlpineBasePackage = "alpine-base"
+	// Used if no components are configured
+	AlpineDefaultComponent = "main"
+)
+
+// Installs Alpine Linux with apk. A statically linked apk (apk.static, as
+// shipped by apk-tools-static) works on any host.
+type apk struct{}
+
+func (a *apk) Name() string {
+	return BootstrapperApk
+}
+
+func (a *apk) Check(spec *BootstrapSpec) error {
+	if _, err := DebToAlpineArch(spec.Architecture); err != nil {
+		return err
+	}
+	if len(spec.Exclude) > 0 {
+		return fmt.Errorf("excluded packages are not supported by apk")
+	}
+	if spec.Variant != "" {
+		return fmt.Errorf("variants are not supported by apk")
+	}
+
+	return nil
+}
+
+// Returns the repositories of all mirrors and components, in the layout of
+// the Alpine mirrors: <mirror>/<release>/<component>. Mirrors may be local
+// directories.
+func apkRepositories(spec *BootstrapSpec) []string {
+	components := spec.Components
+	if len(components) == 0 {
+		components = []string{AlpineDefaultComponent}
+	}
+
+	repositories := []string{}
+	for _, mirror := range spec.Mirrors {
+		mirror = strings.TrimSuffix(strings.TrimPrefix(mirror, "file://"), "/")
+		for _, component := range components {
+			repositories = append(repositories, mirror+"/"+spec.Suite+"/"+component)
+		}
+	}
+
+	return repositories
+}
+
+// Returns the public keys the repositories are verified with, from the
+// keyrings (files or directories of keys)
+func (a *apk) keys(spec *BootstrapSpec) ([]string, error) {
+	keys, err := expandKeyrings(spec.Keyrings)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && !spec.InsecureSkipVerify {
+		return nil, fmt.Errorf("no apk signing keys, '%s' is empty or missing", ApkKeysDir)
+	}
+
+	return keys, nil
+}
+
+// Prepares /etc/apk in the empty rootfs, which apk reads with --root
+func (a *apk) prepareRootfs(spec *BootstrapSpec, rootfs string) error {
+	keys, err := a.keys(spec)
+	if err != nil {
+		return err
+	}
+
+	keysDir := filepath.Join(rootfs, ApkKeysDir)
+	if err = os.MkdirAll(keysDir, 0755); err != nil {
+		return fmt.Errorf("error while creating '%s': %w", ApkKeysDir, err)
+	}
+	for _, key := range keys {
+		if err = copyFile(key, filepath.Join(keysDir, filepath.Base(key)), 0644); err != nil {
+			return fmt.Errorf("error while copying key '%s': %w", key, err)
+		}
+	}
+
+	repositories := strings.Join(apkRepositories(spec), "\n") + "\n"
+	if err = os.WriteFile(filepath.Join(rootfs, ApkRepositoriesPath), []byte(repositories), 0644); err != nil {
+		return fmt.Errorf("error while writing '%s': %w", ApkRepositoriesPath, err)
+	}
+
+	return nil
+}
+
+func (a *apk) args(spec *BootstrapSpec, rootfs string) []string {
+	// Checked by Check
+	arch, _ := DebToAlpineArch(spec.Architecture)
+
+	args := []string{"--root", rootfs, "--initdb", "--arch", arch, "--update-cache", "--no-progress"}
+	if spec.InsecureSkipVerify {
+		args = append(args, "--allow-untrusted")
+	}
+
+	args = append(args, "add", AlpineBasePackage)
+	return append(args, spec.Include...)
+}
+
+func (a *apk) Bootstrap(spec *BootstrapSpec, rootfs string, env *BootstrapEnv) error {
+	tool, err := exec.LookPath("apk.static")
+	if err != nil {
+		if tool, err = exec.LookPath("apk"); err != nil {
+			return fmt.Errorf("apk.static or apk is required to bootstrap Alpine Linux")
+		}
+	}
+
+	if err = a.prepareRootfs(spec, rootfs); err != nil {
+		return err
+	}
+
+	return env.Run(exec.Command(tool, a.args(spec, rootfs)...))
+}
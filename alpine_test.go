@@ -0,0 +1,143 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestApkCheck(t *testing.T) {
+	bootstrapper := &apk{}
+	spec := &BootstrapSpec{Suite: "v3.19", Architecture: "arm64", Mirrors: []string{"https://dl-cdn.alpinelinux.org/alpine"}}
+	if err := bootstrapper.Check(spec); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := map[string]BootstrapSpec{
+		"unsupported architecture": {Suite: "v3.19", Architecture: "armel"},
+		"excluded packages":        {Suite: "v3.19", Architecture: "amd64", Exclude: []string{"busybox"}},
+		"variant":                  {Suite: "v3.19", Architecture: "amd64", Variant: VariantMinbase},
+	}
+	for name, spec := range invalid {
+		if err := bootstrapper.Check(&spec); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestApkRepositories(t *testing.T) {
+	spec := &BootstrapSpec{
+		Suite:      "v3.19",
+		Mirrors:    []string{"https://dl-cdn.alpinelinux.org/alpine/", "file:///srv/apk"},
+		Components: []string{"main", "community"},
+	}
+
+	expected := "https://dl-cdn.alpinelinux.org/alpine/v3.19/main https://dl-cdn.alpinelinux.org/alpine/v3.19/community " +
+		"/srv/apk/v3.19/main /srv/apk/v3.19/community"
+	if repositories := strings.Join(apkRepositories(spec), " "); repositories != expected {
+		t.Errorf("unexpected repositories: %s", repositories)
+	}
+
+	spec.Components = nil
+	if repositories := apkRepositories(spec); len(repositories) != 2 || repositories[1] != "/srv/apk/v3.19/main" {
+		t.Errorf("expected main component by default, got: %v", repositories)
+	}
+}
+
+// Places an executable that does nothing in a directory prepended to PATH
+func fakeExecutable(t *testing.T, name string) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+}
+
+func TestApkBootstrap(t *testing.T) {
+	fakeExecutable(t, "apk.static")
+
+	keysDir := t.TempDir()
+	if err := os.WriteFile(keysDir+"/alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub", []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rootfs := t.TempDir()
+	spec := &BootstrapSpec{Suite: "edge", Architecture: "arm64", Mirrors: []string{"/srv/apk"}, Include: []string{"openssh"}, Keyrings: []string{keysDir}}
+	commands := recordBootstrap(t, &apk{}, spec, rootfs)
+
+	if len(commands) != 1 || !strings.HasSuffix(commands[0], "apk.static --root "+rootfs+" --initdb --arch aarch64 --update-cache --no-progress add alpine-base openssh") {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+
+	if data, _ := os.ReadFile(rootfs + ApkRepositoriesPath); string(data) != "/srv/apk/edge/main\n" {
+		t.Errorf("unexpected repositories file: %q", data)
+	}
+	if _, err := os.Stat(rootfs + ApkKeysDir + "/alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub"); err != nil {
+		t.Errorf("expected key to be copied: %s", err)
+	}
+
+	spec.Keyrings = []string{t.TempDir()}
+	if err := (&apk{}).prepareRootfs(spec, t.TempDir()); err == nil {
+		t.Error("expected error without signing keys")
+	}
+
+	spec.InsecureSkipVerify = true
+	if commands = recordBootstrap(t, &apk{}, spec, t.TempDir()); len(commands) != 1 || !strings.Contains(commands[0], " --no-progress --allow-untrusted add ") {
+		t.Errorf("expected untrusted packages to be allowed, got: %q", commands)
+	}
+}
+
+// Bootstraps Alpine Linux from a local apk repository in the layout of the
+// Alpine mirrors (<mirror>/<release>/main/<arch>/APKINDEX.tar.gz), e.g.
+// ROOTFSBUILDER_TEST_APK_MIRROR=/srv/apk ROOTFSBUILDER_TEST_APK_KEYS=/srv/apk/keys
+func TestApkLocalRepository(t *testing.T) {
+	mirror := os.Getenv("ROOTFSBUILDER_TEST_APK_MIRROR")
+	if mirror == "" {
+		t.Skip("ROOTFSBUILDER_TEST_APK_MIRROR not set")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	release := os.Getenv("ROOTFSBUILDER_TEST_APK_RELEASE")
+	if release == "" {
+		release = "edge"
+	}
+	keys := os.Getenv("ROOTFSBUILDER_TEST_APK_KEYS")
+	if keys == "" {
+		keys = ApkKeysDir
+	}
+	spec := &BootstrapSpec{Suite: release, Architecture: runtime.GOARCH, Mirrors: []string{mirror}, Keyrings: []string{keys}}
+
+	bootstrapper := &apk{}
+	if err := bootstrapper.Check(spec); err != nil {
+		t.Skipf("unsupported host: %s", err)
+	}
+
+	rootfs := t.TempDir()
+	run := func(cmd *exec.Cmd) error {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	if err := bootstrapper.Bootstrap(spec, rootfs, testBootstrapEnv(t, run)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	installed, err := os.ReadFile(rootfs + "/lib/apk/db/installed")
+	if err != nil || !strings.Contains(string(installed), "P:"+AlpineBasePackage+"\n") {
+		t.Errorf("expected %s to be installed: %v", AlpineBasePackage, err)
+	}
+}
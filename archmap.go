@@ -28,6 +28,59 @@ var (
 		"ppc64el":  "ppc64le",
 		"s390x":    "s390x",
 	}
+
+	// Maps debian architecture names to OCI (GOARCH) architecture
+	// names and variants.
+	OCIArchMap = map[string][2]string{
+		"amd64":    {"amd64", ""},
+		"i386":     {"386", ""},
+		"arm64":    {"arm64", "v8"},
+		"armel":    {"arm", "v5"},
+		"armhf":    {"arm", "v7"},
+		"mips":     {"mips", ""},
+		"mipsel":   {"mipsle", ""},
+		"mips64el": {"mips64le", ""},
+		"ppc64el":  {"ppc64le", ""},
+		"s390x":    {"s390x", ""},
+	}
+
+	// Maps debian architecture names to the kernel architecture names
+	// used in LXC/Incus image metadata.
+	LXCArchMap = map[string]string{
+		"amd64":    "x86_64",
+		"i386":     "i686",
+		"arm64":    "aarch64",
+		"armel":    "armv6l",
+		"armhf":    "armv7l",
+		"mips":     "mips",
+		"mipsel":   "mipsel",
+		"mips64el": "mips64el",
+		"ppc64el":  "ppc64le",
+		"s390x":    "s390x",
+	}
+
+	// Maps debian architecture names to the architecture names of Alpine
+	// Linux packages and repositories.
+	AlpineArchMap = map[string]string{
+		"amd64":   "x86_64",
+		"i386":    "x86",
+		"arm64":   "aarch64",
+		"armhf":   "armv7",
+		"ppc64el": "ppc64le",
+		"s390x":   "s390x",
+	}
+
+	// Maps debian architecture names to RPM architecture names, as
+	// passed to dnf --forcearch.
+	RPMArchMap = map[string]string{
+		"amd64":   "x86_64",
+		"i386":    "i686",
+		"arm64":   "aarch64",
+		"armel":   "armv5tel",
+		"armhf":   "armv7hl",
+		"ppc64el": "ppc64le",
+		"s390x":   "s390x",
+	}
 )
 
 func DebToQemuArch(debArch string) (string, error) {
@@ -39,6 +92,43 @@ func DebToQemuArch(debArch string) (string, error) {
 	return arch, nil
 }
 
+// Returns the OCI architecture and variant (may be empty)
+func DebToOCIArch(debArch string) (string, string, error) {
+	arch, ok := OCIArchMap[debArch]
+	if !ok {
+		return "", "", fmt.Errorf("architecture '%s' not found in debian architecture to OCI translation table", debArch)
+	}
+
+	return arch[0], arch[1], nil
+}
+
+func DebToLXCArch(debArch string) (string, error) {
+	arch, ok := LXCArchMap[debArch]
+	if !ok {
+		return "", fmt.Errorf("architecture '%s' not found in debian architecture to LXC translation table", debArch)
+	}
+
+	return arch, nil
+}
+
+func DebToAlpineArch(debArch string) (string, error) {
+	arch, ok := AlpineArchMap[debArch]
+	if !ok {
+		return "", fmt.Errorf("architecture '%s' not found in debian architecture to Alpine translation table", debArch)
+	}
+
+	return arch, nil
+}
+
+func DebToRPMArch(debArch string) (string, error) {
+	arch, ok := RPMArchMap[debArch]
+	if !ok {
+		return "", fmt.Errorf("architecture '%s' not found in debian architecture to RPM translation table", debArch)
+	}
+
+	return arch, nil
+}
+
 func HostToDebArch() (string, error) {
 	buf := bytes.Buffer{}
 
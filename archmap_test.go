@@ -33,4 +33,64 @@ func TestDebToQemuArchInvalidArchitecture(t *testing.T) {
 	}
 }
 
+func TestDebToOCIArch(t *testing.T) {
+	for _, arch := range SupportedDebianArchitectures {
+		ociArch, _, err := DebToOCIArch(arch)
+		if err != nil {
+			t.Errorf("error while translating debian architecture '%s' to OCI architecture: %s", arch, err)
+		}
+
+		if ociArch == "" {
+			t.Errorf("OCI architecture for debian architecture '%s' is empty", arch)
+		}
+	}
+
+	arch, variant, _ := DebToOCIArch("armhf")
+	if arch != "arm" || variant != "v7" {
+		t.Errorf("expected armhf to translate to arm/v7, got: %s/%s", arch, variant)
+	}
+}
+
+func TestDebToLXCArch(t *testing.T) {
+	for _, arch := range SupportedDebianArchitectures {
+		lxcArch, err := DebToLXCArch(arch)
+		if err != nil {
+			t.Errorf("error while translating debian architecture '%s' to LXC architecture: %s", arch, err)
+		}
+
+		if lxcArch == "" {
+			t.Errorf("LXC architecture for debian architecture '%s' is empty", arch)
+		}
+	}
+}
+
 // TODO: TestHostToDebArch
+
+func TestDebToAlpineArch(t *testing.T) {
+	expected := map[string]string{"amd64": "x86_64", "arm64": "aarch64", "armhf": "armv7", "i386": "x86"}
+	for debArch, alpineArch := range expected {
+		arch, err := DebToAlpineArch(debArch)
+		if err != nil || arch != alpineArch {
+			t.Errorf("expected '%s' to translate to '%s', got: '%s', %v", debArch, alpineArch, arch, err)
+		}
+	}
+
+	// Alpine has no soft-float ARM port
+	if _, err := DebToAlpineArch("armel"); err == nil {
+		t.Error("expected error while translating 'armel' to Alpine architecture")
+	}
+}
+
+func TestDebToRPMArch(t *testing.T) {
+	expected := map[string]string{"amd64": "x86_64", "arm64": "aarch64", "armhf": "armv7hl", "i386": "i686", "ppc64el": "ppc64le"}
+	for debArch, rpmArch := range expected {
+		arch, err := DebToRPMArch(debArch)
+		if err != nil || arch != rpmArch {
+			t.Errorf("expected '%s' to translate to '%s', got: '%s', %v", debArch, rpmArch, arch, err)
+		}
+	}
+
+	if _, err := DebToRPMArch("mips64el"); err == nil {
+		t.Error("expected error while translating 'mips64el' to RPM architecture")
+	}
+}
@@ -0,0 +1,316 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The base system to install, independent of the bootstrapper
+type BootstrapSpec struct {
+	// Release to install (e.g. "bookworm")
+	Suite string
+	// Debian naming scheme
+	Architecture string
+	// The first mirror is the primary one
+	Mirrors    []string
+	Components []string
+	Include    []string
+	Exclude    []string
+	Variant    string
+	// Keyrings the release files are verified with
+	Keyrings []string
+	// The debootstrap script, if not the one named after the suite
+	Script string
+	// Packages are not verified
+	InsecureSkipVerify bool
+}
+
+// Installs a base system into an empty rootfs directory
+type Bootstrapper interface {
+	// The name of the bootstrapper, as configured
+	Name() string
+	// Checks whether the spec can be installed, before anything is run
+	Check(spec *BootstrapSpec) error
+	// Installs the base system, with the commands and temporary
+	// directories of env
+	Bootstrap(spec *BootstrapSpec, rootfs string, env *BootstrapEnv) error
+}
+
+// The build, as seen by a bootstrapper. Commands and temporary directories
+// are released on teardown, also when the build is interrupted.
+type BootstrapEnv struct {
+	// Runs a command, interruptible
+	Run func(cmd *exec.Cmd) error
+	// Creates a locked temporary directory outside of the rootfs. The
+	// returned function removes it early.
+	TempDir func(pattern string) (string, func() error, error)
+}
+
+// Returns the configured bootstrapper, or the default of the distribution.
+// Rootless builds default to mmdebstrap instead of debootstrap, as it works
+// without creating device nodes.
+func newBootstrapper(name string, profile *DistributionProfile, rootless bool) (Bootstrapper, error) {
+	if name == "" {
+		name = profile.Bootstrapper
+		if name == BootstrapperDebootstrap && rootless {
+			name = BootstrapperMmdebstrap
+		}
+	}
+
+	switch name {
+	case BootstrapperDebootstrap:
+		if rootless {
+			return nil, fmt.Errorf("debootstrap is not supported by rootless builds, use mmdebstrap")
+		}
+		return &debootstrap{}, nil
+	case BootstrapperMmdebstrap:
+		return &mmdebstrap{rootless: rootless}, nil
+	case BootstrapperApk:
+		return &apk{}, nil
+	case BootstrapperDnf:
+		return &dnf{}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported bootstrapper: '%s'", name)
+}
+
+type debootstrap struct{}
+
+func (d *debootstrap) Name() string {
+	return BootstrapperDebootstrap
+}
+
+func (d *debootstrap) Check(spec *BootstrapSpec) error {
+	if len(spec.Mirrors) != 1 {
+		return fmt.Errorf("debootstrap supports exactly one mirror")
+	}
+	if len(spec.Keyrings) > 1 {
+		return fmt.Errorf("debootstrap supports at most one keyring")
+	}
+
+	return nil
+}
+
+func (d *debootstrap) args(spec *BootstrapSpec, rootfs string) []string {
+	args := []string{}
+	if spec.Variant != "" {
+		args = append(args, "--variant="+spec.Variant)
+	}
+	args = append(args, "--arch="+spec.Architecture)
+	if len(spec.Include) > 0 {
+		args = append(args, "--include="+strings.Join(spec.Include, ","))
+	}
+	if len(spec.Exclude) > 0 {
+		args = append(args, "--exclude="+strings.Join(spec.Exclude, ","))
+	}
+	if len(spec.Components) > 0 {
+		args = append(args, "--components="+strings.Join(spec.Components, ","))
+	}
+	for _, keyring := range spec.Keyrings {
+		args = append(args, "--keyring="+keyring)
+	}
+	if spec.InsecureSkipVerify {
+		args = append(args, "--no-check-gpg")
+	}
+
+	args = append(args, spec.Suite, rootfs, spec.Mirrors[0])
+	if spec.Script != "" {
+		args = append(args, spec.Script)
+	}
+
+	return args
+}
+
+func (d *debootstrap) Bootstrap(spec *BootstrapSpec, rootfs string, env *BootstrapEnv) error {
+	return env.Run(exec.Command("debootstrap", d.args(spec, rootfs)...))
+}
+
+type mmdebstrap struct {
+	// Device nodes cannot be created in a user namespace
+	rootless bool
+}
+
+func (m *mmdebstrap) Name() string {
+	return BootstrapperMmdebstrap
+}
+
+func (m *mmdebstrap) Check(spec *BootstrapSpec) error {
+	if len(spec.Exclude) > 0 {
+		return fmt.Errorf("excluded packages are not supported by mmdebstrap")
+	}
+
+	return nil
+}
+
+func (m *mmdebstrap) args(spec *BootstrapSpec, rootfs string) []string {
+	// The builder owns the rootfs, so no further isolation is needed
+	args := []string{"--mode=root"}
+	if m.rootless {
+		args = append(args, "--skip=output/mknod")
+	}
+	if spec.Variant != "" {
+		args = append(args, "--variant="+spec.Variant)
+	}
+	args = append(args, "--architectures="+spec.Architecture)
+	if len(spec.Include) > 0 {
+		args = append(args, "--include="+strings.Join(spec.Include, ","))
+	}
+	if len(spec.Components) > 0 {
+		args = append(args, "--components="+strings.Join(spec.Components, ","))
+	}
+	for _, keyring := range spec.Keyrings {
+		args = append(args, "--keyring="+keyring)
+	}
+	if spec.InsecureSkipVerify {
+		args = append(args,
+			"--aptopt=Acquire::AllowInsecureRepositories \"true\"",
+			"--aptopt=APT::Get::AllowUnauthenticated \"true\"")
+	}
+
+	args = append(args, spec.Suite, rootfs)
+	return append(args, spec.Mirrors...)
+}
+
+func (m *mmdebstrap) Bootstrap(spec *BootstrapSpec, rootfs string, env *BootstrapEnv) error {
+	return env.Run(exec.Command("mmdebstrap", m.args(spec, rootfs)...))
+}
+
+// Returns the key files of keyrings, which are files or directories of keys
+func expandKeyrings(keyrings []string) ([]string, error) {
+	keys := []string{}
+	for _, keyring := range keyrings {
+		info, err := os.Stat(keyring)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading keyring: %w", err)
+		}
+		if !info.IsDir() {
+			keys = append(keys, keyring)
+			continue
+		}
+
+		entries, err := os.ReadDir(keyring)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading keyring: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				keys = append(keys, filepath.Join(keyring, entry.Name()))
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// Returns the base system described by a configuration, completed by the
+// profile of its distribution
+func newBootstrapSpec(config *ConfigurationV1, profile *DistributionProfile) *BootstrapSpec {
+	return &BootstrapSpec{
+		Suite:              config.Release,
+		Architecture:       config.Architecture,
+		Mirrors:            append([]string{config.Mirror}, config.AdditionalMirrors...),
+		Components:         config.Components,
+		Include:            config.AdditionalPackages,
+		Exclude:            config.ExcludedPackages,
+		Variant:            config.Variant,
+		Keyrings:           profile.keyrings(),
+		Script:             profile.DebootstrapScript,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+}
+
+// Returns the bootstrapper and base system of a configuration
+func configureBootstrap(config *ConfigurationV1, rootless bool) (Bootstrapper, *BootstrapSpec, error) {
+	profile, err := lookupProfile(config.Distribution)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bootstrapper, err := newBootstrapper(config.Bootstrapper, profile, rootless)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bootstrapper.Name() == BootstrapperDebootstrap {
+		if err = profile.checkDebootstrapScript(config.Distribution, config.Release, DebootstrapScriptsDir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = checkKeyring(config, bootstrapper); err != nil {
+		return nil, nil, err
+	}
+
+	spec := newBootstrapSpec(config, profile)
+	if spec.InsecureSkipVerify {
+		spec.Keyrings = nil
+	}
+	if err = bootstrapper.Check(spec); err != nil {
+		return nil, nil, err
+	}
+
+	return bootstrapper, spec, nil
+}
+
+// Checks that the configured bootstrapper can install the configured base
+// system
+func checkBootstrap(config *ConfigurationV1, rootless bool) error {
+	_, _, err := configureBootstrap(config, rootless)
+	return err
+}
+
+// Runs a bootstrapper command with the builder's loggers
+func (b *Builder) runBootstrapCommand(cmd *exec.Cmd) error {
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	fmt.Fprintf(b.loggerErr, "Running %s with args: %s\n", cmd.Args[0], strings.Join(cmd.Args, " "))
+
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while running %s: %w", cmd.Args[0], err)
+	}
+
+	return nil
+}
+
+func (b *Builder) bootstrapEnv() *BootstrapEnv {
+	return &BootstrapEnv{
+		Run: b.runBootstrapCommand,
+		TempDir: func(pattern string) (string, func() error, error) {
+			return b.makeTempDir(os.TempDir(), pattern)
+		},
+	}
+}
+
+// Installs the base system into the rootfs with the configured
+// bootstrapper
+func (b *Builder) bootstrap() error {
+	bootstrapper, spec, err := configureBootstrap(b.config, b.rootless)
+	if err != nil {
+		return err
+	}
+
+	if b.config.Keyring != "" {
+		if spec.Keyrings, err = b.prepareKeyring(bootstrapper, spec.Keyrings); err != nil {
+			return err
+		}
+	}
+	if spec.InsecureSkipVerify {
+		fmt.Fprintf(b.loggerErr, "Warning: packages are not verified (insecure_skip_verify)\n")
+	}
+
+	if err = bootstrapper.Bootstrap(spec, b.rootfs, b.bootstrapEnv()); err != nil {
+		return err
+	}
+
+	return b.installKeyring()
+}
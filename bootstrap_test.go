@@ -0,0 +1,158 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestNewBootstrapper(t *testing.T) {
+	cases := []struct {
+		name         string
+		distribution string
+		rootless     bool
+		expected     string
+	}{
+		{"", DistributionDebian, false, BootstrapperDebootstrap},
+		{"", DistributionDebian, true, BootstrapperMmdebstrap},
+		{"", DistributionAlpine, true, BootstrapperApk},
+		{"", DistributionRocky, false, BootstrapperDnf},
+		{BootstrapperDebootstrap, DistributionUbuntu, false, BootstrapperDebootstrap},
+		{BootstrapperMmdebstrap, DistributionDebian, false, BootstrapperMmdebstrap},
+	}
+	for _, c := range cases {
+		bootstrapper, err := newBootstrapper(c.name, DistributionProfiles[c.distribution], c.rootless)
+		if err != nil || bootstrapper.Name() != c.expected {
+			t.Errorf("'%s' (rootless: %t): expected %s, got: %v, %v", c.name, c.rootless, c.expected, bootstrapper, err)
+		}
+	}
+
+	if _, err := newBootstrapper(BootstrapperDebootstrap, DistributionProfiles[DistributionDebian], true); err == nil {
+		t.Error("expected error for rootless debootstrap")
+	}
+	if _, err := newBootstrapper("cdebootstrap", DistributionProfiles[DistributionDebian], false); err == nil {
+		t.Error("expected error for unsupported bootstrapper")
+	}
+}
+
+// Returns a bootstrap environment that runs commands with run, and creates
+// temporary directories removed with the test
+func testBootstrapEnv(t *testing.T, run func(cmd *exec.Cmd) error) *BootstrapEnv {
+	return &BootstrapEnv{
+		Run: run,
+		TempDir: func(pattern string) (string, func() error, error) {
+			dir, err := os.MkdirTemp(t.TempDir(), pattern)
+			return dir, func() error { return os.RemoveAll(dir) }, err
+		},
+	}
+}
+
+// Returns the arguments of the commands run by a bootstrapper
+func recordBootstrap(t *testing.T, bootstrapper Bootstrapper, spec *BootstrapSpec, rootfs string) []string {
+	commands := []string{}
+	run := func(cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		return nil
+	}
+
+	if err := bootstrapper.Check(spec); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := bootstrapper.Bootstrap(spec, rootfs, testBootstrapEnv(t, run)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	return commands
+}
+
+func TestDebootstrap(t *testing.T) {
+	spec := &BootstrapSpec{
+		Suite:        "bookworm",
+		Architecture: "arm64",
+		Mirrors:      []string{"http://deb.debian.org/debian"},
+		Components:   []string{"main", "contrib"},
+		Include:      []string{"openssh-server", "vim"},
+		Exclude:      []string{"nano"},
+		Variant:      VariantMinbase,
+		Keyrings:     []string{"/usr/share/keyrings/debian-archive-keyring.gpg"},
+		Script:       "sid",
+	}
+
+	commands := recordBootstrap(t, &debootstrap{}, spec, "/tmp/rootfs")
+	expected := "debootstrap --variant=minbase --arch=arm64 --include=openssh-server,vim --exclude=nano " +
+		"--components=main,contrib --keyring=/usr/share/keyrings/debian-archive-keyring.gpg " +
+		"bookworm /tmp/rootfs http://deb.debian.org/debian sid"
+	if len(commands) != 1 || commands[0] != expected {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+
+	spec.Keyrings = nil
+	spec.InsecureSkipVerify = true
+	commands = recordBootstrap(t, &debootstrap{}, spec, "/tmp/rootfs")
+	if len(commands) != 1 || !strings.Contains(commands[0], " --no-check-gpg bookworm ") {
+		t.Errorf("expected signatures not to be checked, got: %q", commands)
+	}
+
+	spec.Mirrors = append(spec.Mirrors, "http://mirror.example.com/debian")
+	if err := (&debootstrap{}).Check(spec); err == nil {
+		t.Error("expected error for multiple mirrors")
+	}
+}
+
+func TestMmdebstrap(t *testing.T) {
+	spec := &BootstrapSpec{
+		Suite:        "bookworm",
+		Architecture: "amd64",
+		Mirrors:      []string{"http://deb.debian.org/debian", "http://mirror.example.com/debian"},
+		Include:      []string{"vim"},
+	}
+
+	commands := recordBootstrap(t, &mmdebstrap{}, spec, "/tmp/rootfs")
+	expected := "mmdebstrap --mode=root --architectures=amd64 --include=vim " +
+		"bookworm /tmp/rootfs http://deb.debian.org/debian http://mirror.example.com/debian"
+	if len(commands) != 1 || commands[0] != expected {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+
+	commands = recordBootstrap(t, &mmdebstrap{rootless: true}, spec, "/tmp/rootfs")
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "mmdebstrap --mode=root --skip=output/mknod ") {
+		t.Errorf("expected device nodes to be skipped, got: %q", commands)
+	}
+
+	spec.InsecureSkipVerify = true
+	commands = recordBootstrap(t, &mmdebstrap{}, spec, "/tmp/rootfs")
+	if len(commands) != 1 || !strings.Contains(commands[0], ` --aptopt=Acquire::AllowInsecureRepositories "true" --aptopt=APT::Get::AllowUnauthenticated "true" `) {
+		t.Errorf("expected unauthenticated packages to be allowed, got: %q", commands)
+	}
+
+	spec.Exclude = []string{"nano"}
+	if err := (&mmdebstrap{}).Check(spec); err == nil {
+		t.Error("expected error for excluded packages")
+	}
+}
+
+func TestCheckBootstrap(t *testing.T) {
+	config := &ConfigurationV1{
+		Distribution:      DistributionDebian,
+		Release:           "bookworm",
+		Architecture:      "amd64",
+		Mirror:            "http://deb.debian.org/debian",
+		AdditionalMirrors: []string{"http://mirror.example.com/debian"},
+	}
+
+	if err := checkBootstrap(config, false); err == nil {
+		t.Error("expected error for additional mirrors with debootstrap")
+	}
+
+	config.Bootstrapper = BootstrapperMmdebstrap
+	if err := checkBootstrap(config, false); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +31,28 @@ type Builder struct {
 	loggerOut        io.Writer
 	loggerErr        io.Writer
 	rootfs           string
+	// Shared by all artifacts of a build
+	buildTime time.Time
+	// Name of the output being built, part of its artifact paths
+	outputName string
+	// Cleanup steps for the resources acquired during the build
+	teardown *Teardown
+	// Restore the originals of files injected for the build
+	ephemeralFiles []func() error
+	// Mount targets created in the rootfs, removed after unmounting
+	createdMountTargets []string
+	// Targets of the bind mounts in the rootfs, below which is the host
+	bindMountTargets []string
+	// Runs as root of a user namespace
+	rootless bool
+	// Codename of the release, if resolved by the preflight
+	codename string
+
+	mu sync.Mutex
+	// Running child processes
+	children map[*childProcess]bool
+	// The signal the build was interrupted with
+	interrupted os.Signal
 }
 
 func NewBuilder(config *ConfigurationV1, hostDebArch string, outDir string, loggerOut io.Writer, loggerErr io.Writer) *Builder {
@@ -39,11 +62,29 @@ func NewBuilder(config *ConfigurationV1, hostDebArch string, outDir string, logg
 		outDir:      outDir,
 		loggerOut:   loggerOut,
 		loggerErr:   loggerErr,
+		teardown:    NewTeardown(loggerErr),
+		rootless:    isRootless(),
+		children:    map[*childProcess]bool{},
 	}
 }
 
-func (b *Builder) Build() (string, error) {
-	args := []string{}
+// Builds the rootfs and all configured outputs. Returns the artifacts of
+// the legacy tarball (if configured) followed by those of each output.
+// Acquired resources are released on return, on panic, and when the build
+// is interrupted by a signal.
+func (b *Builder) Build() (results []BuildResult, err error) {
+	b.buildTime = time.Now()
+
+	stopSignals := b.handleSignals()
+	defer stopSignals()
+	defer func() {
+		if teardownErr := b.teardown.Run(); teardownErr != nil && err == nil {
+			results, err = nil, teardownErr
+		}
+		if interruptErr := b.checkInterrupted(); interruptErr != nil && err == nil {
+			results, err = nil, interruptErr
+		}
+	}()
 
 	// Qemu static availability check
 	if b.config.Architecture != b.hostDebArch {
@@ -52,51 +93,34 @@ func (b *Builder) Build() (string, error) {
 
 		path, binName, err := checkQemuStaticAvailability(b.config.Architecture)
 		if err != nil {
-			return "", fmt.Errorf("qemu-static availability check failed: %w", err)
+			return nil, fmt.Errorf("qemu-static availability check failed: %w", err)
 		}
 
 		b.absoluteQemuPath = path
 		b.qemuBinaryName = binName
 	}
 
-	// Create temporary directory
-	dir, err := os.MkdirTemp(os.TempDir(), "rootfsbuilder-")
-	if err != nil {
-		return "", fmt.Errorf("error while creating temporary directory: %w", err)
+	if b.config.Preflight {
+		if err = b.preflight(); err != nil {
+			return nil, err
+		}
 	}
-	b.rootfs = dir
-	// Defer the removal of the temporary directory
-	defer os.RemoveAll(dir)
 
-	if b.config.Variant != "" {
-		args = append(args, "--variant="+b.config.Variant)
+	// Create temporary directory, unmounted and removed on teardown
+	dir, _, err := b.makeTempDir(os.TempDir(), TempDirPrefix)
+	if err != nil {
+		return nil, err
 	}
-	args = append(args, "--arch="+b.config.Architecture)
+	b.rootfs = dir
 
-	if b.config.AdditionalPackages != nil {
-		args = append(args, "--include="+strings.Join(b.config.AdditionalPackages, ","))
-	}
-	if b.config.ExcludedPackages != nil {
-		args = append(args, "--exclude="+strings.Join(b.config.ExcludedPackages, ","))
+	// The rootfs is used as is by directory outputs, and the root directory
+	// is part of every archive
+	if err = os.Chmod(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error while setting rootfs permissions: %w", err)
 	}
-	if b.config.Components != nil {
-		args = append(args, "--components="+strings.Join(b.config.Components, ","))
-	}
-
-	args = append(args, b.config.Release)
-	args = append(args, b.rootfs)
-	args = append(args, b.config.Mirror)
-
-	cmd := exec.Command("debootstrap", args...)
-
-	// Set loggers
-	cmd.Stdout = b.loggerOut
-	cmd.Stderr = b.loggerErr
 
-	fmt.Fprintf(b.loggerErr, "Running debootstrap with args: %s\n", strings.Join(cmd.Args, " "))
-
-	if err = cmd.Run(); err != nil {
-		return "", fmt.Errorf("error while running debootstrap: %w", err)
+	if err = b.bootstrap(); err != nil {
+		return nil, err
 	}
 
 	// Extract the optional payload
@@ -104,42 +128,83 @@ func (b *Builder) Build() (string, error) {
 		fmt.Fprint(b.loggerErr, "Extracting payload\n")
 		err = b.extractPayload()
 		if err != nil {
-			return "", fmt.Errorf("error while extracting payload: %w", err)
+			return nil, fmt.Errorf("error while extracting payload: %w", err)
 		}
 	}
 
-	needsMount := b.config.PostInstallCommand != "" || b.config.UseHostsResolvConf
-	if needsMount {
+	if b.config.PostInstallCommand != "" {
 		err = b.mountOperations()
 		if err != nil {
-			return "", fmt.Errorf("error while mounting operations: %w", err)
+			return nil, fmt.Errorf("error while mounting operations: %w", err)
 		}
+	} else if b.config.UseHostsResolvConf {
+		fmt.Fprintf(b.loggerErr, "Ignoring use_hosts_resolv_conf, the host's resolv.conf is only used by the post install command\n")
 	}
 
+	if b.config.FinalSources != nil {
+		if err = b.writeFinalSources(); err != nil {
+			return nil, fmt.Errorf("error while writing final sources: %w", err)
+		}
+	}
+
+	results = []BuildResult{}
+
 	// Create tarball
-	withGzip := b.config.TarballType == TarballTypeTarGz
-	tarballPath := fmt.Sprintf("%s/%s-%s-%s-%d.%s",
-		b.outDir, b.config.Distribution,
-		b.config.Release, b.config.Architecture, time.Now().Unix(), b.config.TarballType)
-	flags := "-cpf"
-	if withGzip {
-		flags = "-czpf"
+	if b.config.TarballType != "" {
+		compression := CompressionNone
+		if b.config.TarballType == TarballTypeTarGz {
+			compression = CompressionGzip
+		}
+
+		tarballPath := b.artifactPath(b.config.TarballType)
+		fmt.Fprintf(b.loggerErr, "Creating tarball '%s'\n", tarballPath)
+		if err = b.writeTarball(tarballPath, compression, nil); err != nil {
+			return nil, err
+		}
+
+		results = append(results, BuildResult{Type: OutputTypeTar, Paths: []string{tarballPath}})
 	}
 
-	// Create a tarball of the rootfs. We do not want a leading directory, and
-	// we want to preserve all file attributes, and permissions.
-	cmd = exec.Command("tar", "--xattrs", "--acls", flags, tarballPath, "-C", dir, ".")
+	outputResults, err := b.buildOutputs()
+	if err != nil {
+		return nil, err
+	}
 
-	// Set loggers
-	cmd.Stdout = b.loggerOut
-	cmd.Stderr = b.loggerErr
+	return b.recordRelease(append(results, outputResults...)), nil
+}
 
-	fmt.Fprintf(b.loggerErr, "Running tar with args: %s\n", strings.Join(cmd.Args, " "))
-	if err = cmd.Run(); err != nil {
-		return "", fmt.Errorf("error while running tar: %w", err)
+// Records the built release in the results for the build report
+func (b *Builder) recordRelease(results []BuildResult) []BuildResult {
+	for i := range results {
+		results[i].Release = b.config.Release
+		results[i].Codename = b.codename
 	}
 
-	return tarballPath, nil
+	return results
+}
+
+// Describes the built release for the build report, with the codename of
+// aliases like stable
+func (b *Builder) releaseDescription() string {
+	release := b.config.Release
+	if b.codename != "" && b.codename != release {
+		release = fmt.Sprintf("%s (%s)", release, b.codename)
+	}
+
+	return fmt.Sprintf("%s %s %s", b.config.Distribution, release, b.config.Architecture)
+}
+
+// Returns the path of a build artifact with the given file extension. The
+// name of the output being built is appended to the base name.
+func (b *Builder) artifactPath(extension string) string {
+	name := ""
+	if b.outputName != "" {
+		name = "-" + b.outputName
+	}
+
+	return fmt.Sprintf("%s/%s-%s-%s-%d%s.%s",
+		b.outDir, b.config.Distribution,
+		b.config.Release, b.config.Architecture, b.buildTime.Unix(), name, extension)
 }
 
 // RootFS manipulation
@@ -150,43 +215,37 @@ func (b *Builder) mountOperations() error {
 		return fmt.Errorf("error while mounting aux: %w", err)
 	}
 
-	if b.config.UseHostsResolvConf {
-		fmt.Fprintf(b.loggerErr, "Copying resolv.conf\n")
-		// Copy the host's resolv.conf to the rootfs
-		cmd := exec.Command("cp", "/etc/resolv.conf", b.rootfs+"/etc/resolv.conf")
-		if err = cmd.Run(); err != nil {
-			_ = b.unmountRootfs()
-			return fmt.Errorf("error while copying resolv.conf: %w", err)
-		}
+	// Build-time files are injected before anything runs in the chroot,
+	// and restored before the rootfs is packaged
+	if err = b.injectBuildFiles(); err != nil {
+		return fmt.Errorf("error while injecting build files: %w", err)
 	}
 
-	if b.config.PostInstallCommand != "" {
-		if b.needsQemu {
-			fmt.Fprintf(b.loggerErr, "Copying qemu-static into rootfs for script execution\n")
-
-			// Copy qemu-static into the rootfs /usr/bin directory
-			cmd := exec.Command("cp", b.absoluteQemuPath, b.rootfs+"/usr/bin/"+b.qemuBinaryName)
-			if err = cmd.Run(); err != nil {
-				_ = b.unmountRootfs()
-				return fmt.Errorf("error while copying qemu-static: %w", err)
-			}
+	if b.needsQemu {
+		fmt.Fprintf(b.loggerErr, "Copying qemu-static into rootfs for script execution\n")
+		if _, err = b.injectCopy("/usr/bin/"+b.qemuBinaryName, b.absoluteQemuPath, 0755); err != nil {
+			return fmt.Errorf("error while copying qemu-static: %w", err)
 		}
+	}
 
-		err = b.runInRoofs(b.config.PostInstallCommand)
-		if err != nil {
-			// We do not want to leave the rootfs mounted
-			_ = b.unmountRootfs()
-			return fmt.Errorf("error while running post install command: %w", err)
-		}
+	fmt.Fprintf(b.loggerErr, "Preventing services from starting in rootfs\n")
+	restoreDaemons, err := b.preventDaemons()
+	if err != nil {
+		return fmt.Errorf("error while preventing services from starting: %w", err)
+	}
 
-		// Remove qemu-static from the rootfs
-		if b.needsQemu {
-			fmt.Fprintf(b.loggerErr, "Removing qemu-static from rootfs...\n")
-			err = os.Remove(b.rootfs + "/usr/bin/" + b.qemuBinaryName)
-			if err != nil {
-				return fmt.Errorf("error while removing qemu-static from rootfs: %w", err)
-			}
-		}
+	err = b.runInRoofs(b.config.PostInstallCommand)
+	if err != nil {
+		return fmt.Errorf("error while running post install command: %w", err)
+	}
+
+	if err = restoreDaemons(); err != nil {
+		return fmt.Errorf("error while restoring service control: %w", err)
+	}
+
+	fmt.Fprintf(b.loggerErr, "Removing build files from rootfs\n")
+	if err = b.restoreEphemeralFiles(); err != nil {
+		return fmt.Errorf("error while restoring build files: %w", err)
 	}
 
 	fmt.Fprintf(b.loggerErr, "Unmounting filesystems\n")
@@ -207,30 +266,20 @@ func (b *Builder) extractPayload() error {
 	absolutePayloadPath := path.Dir(b.config.absoluteConfigPath) + "/" + b.config.Payload
 
 	cmd := exec.Command("tar", flags, absolutePayloadPath, "-C", b.rootfs)
-	if err := cmd.Run(); err != nil {
+	if err := b.runCommand(cmd); err != nil {
 		return fmt.Errorf("error while extracting payload: %w", err)
 	}
 
 	return nil
 }
 
-// mount -t proc none "$ROOTFS_PATH/proc"
-// mount -t sysfs none "$ROOTFS_PATH/sys"
-// mount -o bind /dev "$ROOTFS_PATH/dev"
+// Mounts the default and configured filesystems (proc, sysfs, /dev, ...)
+// into the rootfs
 func (b *Builder) mountAux() error {
-	cmd := exec.Command("mount", "-t", "proc", "none", b.rootfs+"/proc")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mounting proc: %w", err)
-	}
-
-	cmd = exec.Command("mount", "-t", "sysfs", "none", b.rootfs+"/sys")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mounting sysfs: %w", err)
-	}
-
-	cmd = exec.Command("mount", "-o", "bind", "/dev", b.rootfs+"/dev")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("mounting /dev: %w", err)
+	for _, mount := range effectiveMounts(b.config.Mounts, b.rootless) {
+		if err := b.mountInRootfs(mount); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -256,7 +305,7 @@ func (b *Builder) runInRoofs(command string, args ...string) error {
 
 	fmt.Fprintf(b.loggerErr, "Running command '%s' in rootfs 'chroot %s'\n", command, strings.Join(cmdArgs, " "))
 
-	if err := cmd.Run(); err != nil {
+	if err := b.runCommand(cmd); err != nil {
 		return fmt.Errorf("error while running command '%s': %w", command, err)
 	}
 
@@ -280,21 +329,13 @@ func checkQemuStaticAvailability(debArch string) (string, string, error) {
 	return binaryPath, binaryName, nil
 }
 
+// Unmounts everything in the rootfs, including mounts created by the post
+// install command, and removes the mount targets created for the mounts
 func (b *Builder) unmountRootfs() error {
-	cmd := exec.Command("umount", b.rootfs+"/proc")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("unmounting proc: %w", err)
-	}
-
-	cmd = exec.Command("umount", b.rootfs+"/sys")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("unmounting sysfs: %w", err)
+	if err := unmountAll(b.rootfs, b.loggerErr); err != nil {
+		return err
 	}
+	b.bindMountTargets = nil
 
-	cmd = exec.Command("umount", b.rootfs+"/dev")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("unmounting /dev: %w", err)
-	}
-
-	return nil
+	return b.removeCreatedMountTargets()
 }
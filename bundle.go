@@ -0,0 +1,287 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	OCIRuntimeSpecVersion = "1.0.2"
+)
+
+var (
+	// Same defaults as 'runc spec'
+	DefaultRuntimeNamespaces   = []string{"pid", "network", "ipc", "uts", "mount", "cgroup"}
+	DefaultRuntimeCapabilities = []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+	supportedRuntimeNamespaces = map[string]bool{
+		"pid": true, "network": true, "ipc": true, "uts": true, "mount": true, "cgroup": true, "time": true,
+	}
+)
+
+type runtimeUser struct {
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+type runtimeCapabilities struct {
+	Bounding  []string `json:"bounding"`
+	Effective []string `json:"effective"`
+	Permitted []string `json:"permitted"`
+}
+
+type runtimeRlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+type runtimeProcess struct {
+	Terminal        bool                `json:"terminal"`
+	User            runtimeUser         `json:"user"`
+	Args            []string            `json:"args"`
+	Env             []string            `json:"env"`
+	Cwd             string              `json:"cwd"`
+	Capabilities    runtimeCapabilities `json:"capabilities"`
+	Rlimits         []runtimeRlimit     `json:"rlimits"`
+	NoNewPrivileges bool                `json:"noNewPrivileges"`
+}
+
+type runtimeRoot struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type runtimeMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type runtimeNamespace struct {
+	Type string `json:"type"`
+}
+
+type runtimeLinux struct {
+	Namespaces    []runtimeNamespace `json:"namespaces"`
+	MaskedPaths   []string           `json:"maskedPaths"`
+	ReadonlyPaths []string           `json:"readonlyPaths"`
+}
+
+type runtimeSpec struct {
+	OCIVersion string         `json:"ociVersion"`
+	Process    runtimeProcess `json:"process"`
+	Root       runtimeRoot    `json:"root"`
+	Hostname   string         `json:"hostname,omitempty"`
+	Mounts     []runtimeMount `json:"mounts"`
+	Linux      runtimeLinux   `json:"linux"`
+}
+
+func checkBundleOutput(output *OutputV1) error {
+	for _, namespace := range output.Runtime.Namespaces {
+		if namespace == "user" {
+			return fmt.Errorf("user namespaces require ID mappings, which are not supported")
+		}
+		if !supportedRuntimeNamespaces[namespace] {
+			return fmt.Errorf("unsupported namespace '%s'", namespace)
+		}
+	}
+
+	for _, capability := range output.Runtime.Capabilities {
+		if !strings.HasPrefix(capability, "CAP_") {
+			return fmt.Errorf("malformed capability '%s'", capability)
+		}
+	}
+
+	return checkImageConfig(&output.Image)
+}
+
+// Looks up a user or group name in a passwd or group file. Returns the
+// ID, and the primary group ID for passwd entries.
+func lookupIDFile(filePath string, name string) (uint32, uint32, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("malformed entry for '%s' in '%s'", name, filePath)
+		}
+		gid, _ := strconv.ParseUint(fields[3], 10, 32)
+
+		return uint32(id), uint32(gid), nil
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	return 0, 0, fmt.Errorf("'%s' not found in '%s'", name, filePath)
+}
+
+// Resolves "user[:group]" to numeric IDs using the rootfs' passwd and group
+// files. Numeric IDs are used as is.
+func resolveUser(rootfs string, user string) (runtimeUser, error) {
+	if user == "" {
+		return runtimeUser{}, nil
+	}
+
+	name, group := user, ""
+	if i := strings.Index(user, ":"); i >= 0 {
+		name, group = user[:i], user[i+1:]
+	}
+
+	resolved := runtimeUser{}
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		resolved.UID = uint32(uid)
+		resolved.GID = uint32(uid)
+	} else {
+		uid, gid, err := lookupIDFile(filepath.Join(rootfs, "etc", "passwd"), name)
+		if err != nil {
+			return resolved, fmt.Errorf("error while resolving user: %w", err)
+		}
+		resolved.UID, resolved.GID = uid, gid
+	}
+
+	if group == "" {
+		return resolved, nil
+	}
+
+	if gid, err := strconv.ParseUint(group, 10, 32); err == nil {
+		resolved.GID = uint32(gid)
+	} else {
+		gid, _, err := lookupIDFile(filepath.Join(rootfs, "etc", "group"), group)
+		if err != nil {
+			return resolved, fmt.Errorf("error while resolving group: %w", err)
+		}
+		resolved.GID = gid
+	}
+
+	return resolved, nil
+}
+
+// Generates a runtime configuration similar to the one created by 'runc spec'.
+func (b *Builder) newRuntimeSpec(output *OutputV1) (*runtimeSpec, error) {
+	user, err := resolveUser(b.rootfs, output.Image.User)
+	if err != nil {
+		return nil, err
+	}
+
+	args := append(append([]string{}, output.Image.Entrypoint...), output.Image.Cmd...)
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+
+	env := imageEnv(&output.Image)
+	if output.Runtime.Terminal {
+		env = append(env, "TERM=xterm")
+	}
+
+	cwd := output.Image.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+
+	capabilities := output.Runtime.Capabilities
+	if len(capabilities) == 0 {
+		capabilities = DefaultRuntimeCapabilities
+	}
+
+	namespaces := output.Runtime.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = DefaultRuntimeNamespaces
+	}
+
+	spec := &runtimeSpec{
+		OCIVersion: OCIRuntimeSpecVersion,
+		Process: runtimeProcess{
+			Terminal: output.Runtime.Terminal,
+			User:     user,
+			Args:     args,
+			Env:      env,
+			Cwd:      cwd,
+			Capabilities: runtimeCapabilities{
+				Bounding:  capabilities,
+				Effective: capabilities,
+				Permitted: capabilities,
+			},
+			Rlimits:         []runtimeRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     runtimeRoot{Path: "rootfs", Readonly: output.Runtime.ReadOnly},
+		Hostname: output.Runtime.Hostname,
+		Mounts: []runtimeMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: runtimeLinux{
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+
+	for _, namespace := range namespaces {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, runtimeNamespace{Type: namespace})
+	}
+
+	return spec, nil
+}
+
+// Builds an OCI runtime bundle: a copy of the rootfs and a config.json
+// that can be run with 'runc run' or 'crun run'.
+func (b *Builder) buildRuntimeBundle(output *OutputV1, bundlePath string) error {
+	spec, err := b.newRuntimeSpec(output)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err = os.Mkdir(bundlePath, 0755); err != nil {
+		return fmt.Errorf("error while creating bundle directory: %w", err)
+	}
+
+	if err = b.copyTree(b.rootfs, filepath.Join(bundlePath, "rootfs"), false); err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(bundlePath, "config.json"), data, 0644); err != nil {
+		return fmt.Errorf("error while writing config.json: %w", err)
+	}
+
+	return nil
+}
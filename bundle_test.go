@@ -0,0 +1,115 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestAccounts(t *testing.T, rootfs string) {
+	passwd := "root:x:0:0:root:/root:/bin/bash\nnobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin\n"
+	group := "root:x:0:\nvideo:x:44:\n"
+
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	writeTestAccounts(t, builder.rootfs)
+
+	users := map[string]runtimeUser{
+		"":             {UID: 0, GID: 0},
+		"nobody":       {UID: 65534, GID: 65534},
+		"nobody:video": {UID: 65534, GID: 44},
+		"1000":         {UID: 1000, GID: 1000},
+		"1000:44":      {UID: 1000, GID: 44},
+	}
+
+	for user, expected := range users {
+		resolved, err := resolveUser(builder.rootfs, user)
+		if err != nil {
+			t.Errorf("expected no error while resolving '%s', got: %s", user, err)
+		}
+		if resolved != expected {
+			t.Errorf("expected '%s' to resolve to %v, got: %v", user, expected, resolved)
+		}
+	}
+
+	for _, user := range []string{"nonexistent", "root:nonexistent"} {
+		if _, err := resolveUser(builder.rootfs, user); err == nil {
+			t.Errorf("expected error while resolving '%s'", user)
+		}
+	}
+}
+
+func TestCheckBundleOutput(t *testing.T) {
+	if err := checkBundleOutput(&OutputV1{Type: OutputTypeBundle, Runtime: RuntimeConfigV1{Namespaces: []string{"pid", "mount"}}}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := []RuntimeConfigV1{
+		{Namespaces: []string{"user"}},
+		{Namespaces: []string{"net"}},
+		{Capabilities: []string{"NET_ADMIN"}},
+	}
+	for _, runtime := range invalid {
+		if err := checkBundleOutput(&OutputV1{Type: OutputTypeBundle, Runtime: runtime}); err == nil {
+			t.Errorf("expected error for runtime configuration %v", runtime)
+		}
+	}
+}
+
+func TestBuildRuntimeBundle(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	writeTestAccounts(t, builder.rootfs)
+
+	output := &OutputV1{
+		Type:    OutputTypeBundle,
+		Image:   ImageConfigV1{Entrypoint: []string{"/sbin/init"}, Cmd: []string{"--log-level=info"}, User: "nobody"},
+		Runtime: RuntimeConfigV1{Hostname: "device", Terminal: true},
+	}
+
+	bundlePath := builder.artifactPath("bundle")
+	if err := builder.buildRuntimeBundle(output, bundlePath); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(bundlePath, "rootfs", "etc", "hostname")); err != nil {
+		t.Errorf("expected rootfs to be copied into the bundle")
+	}
+
+	data, err := os.ReadFile(filepath.Join(bundlePath, "config.json"))
+	if err != nil {
+		t.Fatalf("expected config.json to exist, got: %s", err)
+	}
+
+	spec := runtimeSpec{}
+	if err = json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spec.Process.Args) != 2 || spec.Process.Args[0] != "/sbin/init" {
+		t.Errorf("unexpected process args: %v", spec.Process.Args)
+	}
+	if spec.Process.User.UID != 65534 {
+		t.Errorf("expected process to run as nobody, got: %d", spec.Process.User.UID)
+	}
+	if spec.Root.Path != "rootfs" || spec.Hostname != "device" {
+		t.Errorf("unexpected root or hostname: %s, %s", spec.Root.Path, spec.Hostname)
+	}
+	if len(spec.Linux.Namespaces) != len(DefaultRuntimeNamespaces) {
+		t.Errorf("expected default namespaces, got: %v", spec.Linux.Namespaces)
+	}
+}
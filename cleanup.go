@@ -0,0 +1,83 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// Prefix of the temporary directories created by builds
+	TempDirPrefix = "rootfsbuilder-"
+)
+
+// Takes an exclusive lock on a directory, held until the returned file is
+// closed. Marks temporary directories as in use by a running build.
+func lockDir(dir string) (*os.File, error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return fd, nil
+}
+
+// Unmounts and removes the temporary directories left behind by crashed
+// builds in tempDir. Directories locked by a running build are skipped.
+// Returns the removed directories.
+func cleanupStaleDirs(tempDir string, logger io.Writer) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(tempDir, TempDirPrefix+"*"))
+	if err != nil {
+		return nil, fmt.Errorf("error while searching temporary directories: %w", err)
+	}
+
+	removed := []string{}
+	var firstErr error
+
+	for _, dir := range matches {
+		info, err := os.Lstat(dir)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+
+		lock, err := lockDir(dir)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			fmt.Fprintf(logger, "Skipping '%s', in use by a running build\n", dir)
+			continue
+		} else if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error while locking '%s': %w", dir, err)
+			}
+			continue
+		}
+
+		fmt.Fprintf(logger, "Removing stale directory '%s'\n", dir)
+		err = removeUnmounted(dir, logger)
+		lock.Close()
+		if err != nil {
+			fmt.Fprintf(logger, "%s\n", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		removed = append(removed, dir)
+	}
+
+	return removed, firstErr
+}
@@ -0,0 +1,43 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCleanupStaleDirs(t *testing.T) {
+	tempDir := t.TempDir()
+
+	for _, dir := range []string{"rootfsbuilder-stale", "rootfsbuilder-running", "unrelated"} {
+		if err := os.MkdirAll(tempDir+"/"+dir+"/etc", 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lock, err := lockDir(tempDir + "/rootfsbuilder-running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	removed, err := cleanupStaleDirs(tempDir, io.Discard)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if len(removed) != 1 || removed[0] != tempDir+"/rootfsbuilder-stale" {
+		t.Errorf("expected only the stale directory to be removed, got: %v", removed)
+	}
+	for _, dir := range []string{"rootfsbuilder-running", "unrelated"} {
+		if _, err = os.Stat(tempDir + "/" + dir); err != nil {
+			t.Errorf("expected '%s' to be kept", dir)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionXz   = "xz"
+	CompressionZstd = "zstd"
+	CompressionLz4  = "lz4"
+)
+
+var (
+	// File extensions of the compression formats
+	CompressionExtensions = map[string]string{
+		"":              "",
+		CompressionNone: "",
+		CompressionGzip: ".gz",
+		CompressionXz:   ".xz",
+		CompressionZstd: ".zst",
+		CompressionLz4:  ".lz4",
+	}
+
+	// External compressors writing to stdout. The options are chosen so
+	// that the kernel can decompress the result (e.g. for initramfs).
+	compressorCommands = map[string][]string{
+		CompressionXz:   {"xz", "--check=crc32", "-c"},
+		CompressionZstd: {"zstd", "-q", "-c"},
+		CompressionLz4:  {"lz4", "-l", "-q", "-c"},
+	}
+)
+
+func checkCompression(compression string) error {
+	if _, ok := CompressionExtensions[compression]; !ok {
+		return fmt.Errorf("unsupported compression '%s'", compression)
+	}
+
+	return nil
+}
+
+// Pipes everything written through an external compressor
+type commandCompressor struct {
+	name  string
+	stdin io.WriteCloser
+	// Waits for the compressor to exit
+	wait func() error
+}
+
+func (c *commandCompressor) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandCompressor) Close() error {
+	if err := c.stdin.Close(); err != nil {
+		c.wait()
+		return err
+	}
+
+	if err := c.wait(); err != nil {
+		return fmt.Errorf("error while running %s: %w", c.name, err)
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Returns a writer compressing into w. Gzip is handled natively, other
+// formats require the compressor to be installed. Closing the writer
+// flushes the compressor, but does not close w. External compressors are
+// child processes of the build, stopped when it is interrupted.
+func (b *Builder) newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	}
+
+	args, ok := compressorCommands[compression]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression '%s'", compression)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = w
+	cmd.Stderr = b.loggerErr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	wait, err := b.startCommand(cmd)
+	if err != nil {
+		stdin.Close()
+		return nil, fmt.Errorf("error while starting %s: %w", args[0], err)
+	}
+
+	return &commandCompressor{name: args[0], stdin: stdin, wait: wait}, nil
+}
@@ -0,0 +1,64 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func checkConversion(conversion *ConversionV1) error {
+	switch conversion.Format {
+	case ImageFormatQcow2:
+	case ImageFormatVmdk, ImageFormatVhdx:
+		if conversion.Compress {
+			return fmt.Errorf("compression is only supported for qcow2 images")
+		}
+	default:
+		return fmt.Errorf("unsupported image format '%s'", conversion.Format)
+	}
+
+	return nil
+}
+
+// Returns the path of the converted image next to the raw image
+func convertedImagePath(rawPath string, format string) string {
+	return strings.TrimSuffix(rawPath, ".img") + "." + format
+}
+
+func qemuImgConvertArgs(rawPath string, imagePath string, conversion *ConversionV1) []string {
+	args := []string{"convert", "-f", "raw", "-O", conversion.Format}
+
+	switch conversion.Format {
+	case ImageFormatQcow2:
+		if conversion.Compress {
+			args = append(args, "-c")
+		}
+	case ImageFormatVhdx:
+		args = append(args, "-o", "subformat=dynamic")
+	}
+
+	return append(args, rawPath, imagePath)
+}
+
+// Converts a raw disk image with qemu-img. Returns the path to the
+// converted image.
+func (b *Builder) convertImage(rawPath string, conversion *ConversionV1) (string, error) {
+	imagePath := convertedImagePath(rawPath, conversion.Format)
+
+	cmd := exec.Command("qemu-img", qemuImgConvertArgs(rawPath, imagePath, conversion)...)
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	fmt.Fprintf(b.loggerErr, "Running qemu-img with args: %s\n", strings.Join(cmd.Args, " "))
+	if err := b.runCommand(cmd); err != nil {
+		return "", fmt.Errorf("error while running qemu-img: %w", err)
+	}
+
+	return imagePath, nil
+}
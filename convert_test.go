@@ -0,0 +1,60 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConversion(t *testing.T) {
+	valid := []ConversionV1{
+		{Format: ImageFormatQcow2},
+		{Format: ImageFormatQcow2, Compress: true},
+		{Format: ImageFormatVmdk},
+		{Format: ImageFormatVhdx},
+	}
+	for _, conversion := range valid {
+		if err := checkConversion(&conversion); err != nil {
+			t.Errorf("expected no error for format '%s', got: %s", conversion.Format, err)
+		}
+	}
+
+	invalid := []ConversionV1{
+		{Format: "vdi"},
+		{Format: ImageFormatVmdk, Compress: true},
+	}
+	for _, conversion := range invalid {
+		if err := checkConversion(&conversion); err == nil {
+			t.Errorf("expected error for format '%s'", conversion.Format)
+		}
+	}
+
+	output := testDiskOutput()
+	output.Convert = []ConversionV1{{Format: ImageFormatQcow2}, {Format: ImageFormatVmdk}}
+	if err := checkDiskOutput(output); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	output.Convert = append(output.Convert, ConversionV1{Format: ImageFormatQcow2, Compress: true})
+	if err := checkDiskOutput(output); err == nil {
+		t.Error("expected error for duplicate format")
+	}
+}
+
+func TestQemuImgConvertArgs(t *testing.T) {
+	imagePath := convertedImagePath("/out/debian-bookworm-arm64-1.img", ImageFormatQcow2)
+	if imagePath != "/out/debian-bookworm-arm64-1.qcow2" {
+		t.Errorf("unexpected converted image path: %s", imagePath)
+	}
+
+	args := qemuImgConvertArgs("/out/debian-bookworm-arm64-1.img", imagePath, &ConversionV1{Format: ImageFormatQcow2, Compress: true})
+	expected := "convert -f raw -O qcow2 -c /out/debian-bookworm-arm64-1.img /out/debian-bookworm-arm64-1.qcow2"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected args '%s', got: '%s'", expected, strings.Join(args, " "))
+	}
+}
@@ -0,0 +1,336 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	cpioNewcMagic   = "070701"
+	cpioTrailerName = "TRAILER!!!"
+	// Largest file size representable in a newc header
+	cpioMaxFileSize = 0xffffffff
+)
+
+// Writes archives in the "new" (newc) ASCII cpio format, which is the
+// format expected by the kernel for initramfs images.
+type cpioWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+type cpioHeader struct {
+	Name     string
+	Ino      uint32
+	Mode     uint32
+	UID      uint32
+	GID      uint32
+	Nlink    uint32
+	Mtime    int64
+	Size     int64
+	DevMajor uint32
+	DevMinor uint32
+	// Device number of character and block devices
+	RdevMajor uint32
+	RdevMinor uint32
+}
+
+func (c *cpioWriter) write(data []byte) error {
+	n, err := c.w.Write(data)
+	c.offset += int64(n)
+	return err
+}
+
+// Pads the archive to a multiple of four bytes
+func (c *cpioWriter) pad() error {
+	if rem := c.offset % 4; rem != 0 {
+		return c.write(make([]byte, 4-rem))
+	}
+
+	return nil
+}
+
+// Writes a header followed by the name. The file data must be written
+// with WriteData afterwards.
+func (c *cpioWriter) WriteHeader(hdr *cpioHeader) error {
+	if hdr.Size > cpioMaxFileSize {
+		return fmt.Errorf("file '%s' is too large for the cpio format", hdr.Name)
+	}
+
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioNewcMagic, hdr.Ino, hdr.Mode, hdr.UID, hdr.GID, hdr.Nlink, uint32(hdr.Mtime),
+		uint32(hdr.Size), hdr.DevMajor, hdr.DevMinor, hdr.RdevMajor, hdr.RdevMinor,
+		len(hdr.Name)+1, 0)
+
+	if err := c.write([]byte(header + hdr.Name + "\x00")); err != nil {
+		return err
+	}
+
+	return c.pad()
+}
+
+func (c *cpioWriter) WriteData(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := c.write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return c.pad()
+}
+
+// Writes the trailer that terminates the archive
+func (c *cpioWriter) Close() error {
+	return c.WriteHeader(&cpioHeader{Name: cpioTrailerName, Nlink: 1})
+}
+
+// Splits a Linux device number into major and minor
+func splitDevice(dev uint64) (uint32, uint32) {
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
+
+type cpioEntry struct {
+	hdr       cpioHeader
+	path      string
+	hasData   bool
+	isSymlink bool
+}
+
+// Collects the archive entries of a directory tree. Hardlinked files share
+// an inode number, and only the last link carries the file data, like GNU
+// cpio does.
+func collectCpioEntries(root string, skip map[string]bool) ([]cpioEntry, error) {
+	entries := []cpioEntry{}
+	links := map[[2]uint64][]int{}
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		if skip[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unable to stat '%s'", filePath)
+		}
+
+		entry := cpioEntry{
+			hdr: cpioHeader{
+				Name:  filepath.ToSlash(rel),
+				Mode:  st.Mode,
+				UID:   st.Uid,
+				GID:   st.Gid,
+				Nlink: 1,
+				Mtime: info.ModTime().Unix(),
+			},
+			path: filePath,
+		}
+
+		switch info.Mode() & os.ModeType {
+		case 0:
+			entry.hdr.Size = info.Size()
+			entry.hasData = true
+
+			if st.Nlink > 1 {
+				key := [2]uint64{uint64(st.Dev), st.Ino}
+				links[key] = append(links[key], len(entries))
+			}
+		case os.ModeSymlink:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			entry.hdr.Size = int64(len(target))
+			entry.hasData = true
+			entry.isSymlink = true
+		case os.ModeDevice, os.ModeDevice | os.ModeCharDevice:
+			entry.hdr.RdevMajor, entry.hdr.RdevMinor = splitDevice(uint64(st.Rdev))
+		case os.ModeDir:
+			entry.hdr.Nlink = 2
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, indices := range links {
+		if len(indices) < 2 {
+			continue
+		}
+
+		for i, index := range indices {
+			entries[index].hdr.Nlink = uint32(len(indices))
+			if i != len(indices)-1 {
+				entries[index].hdr.Size = 0
+				entries[index].hasData = false
+			}
+		}
+	}
+
+	// Number the inodes, and let hardlinks share theirs
+	ino := uint32(1)
+	for i := range entries {
+		entries[i].hdr.Ino = ino
+		ino++
+	}
+	for _, indices := range links {
+		for _, index := range indices {
+			entries[index].hdr.Ino = entries[indices[0]].hdr.Ino
+		}
+	}
+
+	return entries, nil
+}
+
+// Writes a newc cpio archive of the rootfs. If initPath is set, the file is
+// added as /init instead of the rootfs' /init.
+func writeCpioArchive(w io.Writer, rootfs string, initPath string) error {
+	skip := map[string]bool{}
+	if initPath != "" {
+		skip["init"] = true
+	}
+
+	entries, err := collectCpioEntries(rootfs, skip)
+	if err != nil {
+		return fmt.Errorf("error while reading rootfs: %w", err)
+	}
+
+	if initPath != "" {
+		info, err := os.Stat(initPath)
+		if err != nil {
+			return fmt.Errorf("error while reading init: %w", err)
+		}
+
+		entries = append(entries, cpioEntry{
+			hdr: cpioHeader{
+				Name:  "init",
+				Ino:   uint32(len(entries) + 1),
+				Mode:  syscall.S_IFREG | 0755,
+				Nlink: 1,
+				Mtime: info.ModTime().Unix(),
+				Size:  info.Size(),
+			},
+			path:    initPath,
+			hasData: true,
+		})
+	}
+
+	cw := &cpioWriter{w: w}
+
+	for i := range entries {
+		entry := &entries[i]
+		if err = cw.WriteHeader(&entry.hdr); err != nil {
+			return err
+		}
+
+		if !entry.hasData {
+			continue
+		}
+
+		if entry.isSymlink {
+			target, err := os.Readlink(entry.path)
+			if err != nil {
+				return err
+			}
+			if err = cw.write([]byte(target)); err != nil {
+				return err
+			}
+			if err = cw.pad(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fd, err := os.Open(entry.path)
+		if err != nil {
+			return err
+		}
+		err = cw.WriteData(io.LimitReader(fd, entry.hdr.Size))
+		fd.Close()
+		if err != nil {
+			return fmt.Errorf("error while writing '%s': %w", entry.hdr.Name, err)
+		}
+	}
+
+	return cw.Close()
+}
+
+func checkCpioOutput(output *OutputV1) error {
+	if err := checkCompression(output.Compression); err != nil {
+		return err
+	}
+
+	if output.Init != "" && path.IsAbs(output.Init) {
+		return fmt.Errorf("init '%s' must be relative to the configuration file", output.Init)
+	}
+
+	return nil
+}
+
+// Builds a (compressed) cpio archive of the rootfs, that can be used as an
+// initramfs.
+func (b *Builder) buildCpioArchive(output *OutputV1, archivePath string) error {
+	initPath := ""
+	if output.Init != "" {
+		initPath = path.Dir(b.config.absoluteConfigPath) + "/" + output.Init
+	}
+
+	fd, err := os.Create(archivePath)
+	if err != nil {
+		return fmt.Errorf("error while creating archive: %w", err)
+	}
+	defer fd.Close()
+
+	compressor, err := b.newCompressor(fd, output.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err = writeCpioArchive(compressor, b.rootfs, initPath); err != nil {
+		compressor.Close()
+		return err
+	}
+
+	if err = compressor.Close(); err != nil {
+		return fmt.Errorf("error while compressing archive: %w", err)
+	}
+
+	return fd.Close()
+}
@@ -0,0 +1,172 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+type testCpioEntry struct {
+	hdr  cpioHeader
+	data string
+}
+
+// Minimal newc reader for verifying archives
+func readTestCpio(t *testing.T, data []byte) map[string]testCpioEntry {
+	entries := map[string]testCpioEntry{}
+	offset := 0
+	align := func() {
+		offset = (offset + 3) &^ 3
+	}
+
+	for {
+		if offset+110 > len(data) || string(data[offset:offset+6]) != cpioNewcMagic {
+			t.Fatalf("malformed cpio header at offset %d", offset)
+		}
+
+		fields := make([]uint32, 13)
+		for i := range fields {
+			start := offset + 6 + i*8
+			value, err := strconv.ParseUint(string(data[start:start+8]), 16, 32)
+			if err != nil {
+				t.Fatalf("malformed cpio header field: %s", err)
+			}
+			fields[i] = uint32(value)
+		}
+		offset += 110
+
+		nameSize := int(fields[11])
+		name := string(data[offset : offset+nameSize-1])
+		offset += nameSize
+		align()
+
+		if name == cpioTrailerName {
+			return entries
+		}
+
+		size := int(fields[6])
+		entries[name] = testCpioEntry{
+			hdr: cpioHeader{
+				Name: name, Ino: fields[0], Mode: fields[1], UID: fields[2], GID: fields[3],
+				Nlink: fields[4], Size: int64(size), RdevMajor: fields[9], RdevMinor: fields[10],
+			},
+			data: string(data[offset : offset+size]),
+		}
+		offset += size
+		align()
+	}
+}
+
+func TestCheckCpioOutput(t *testing.T) {
+	if err := checkCpioOutput(&OutputV1{Type: OutputTypeCpio, Compression: CompressionZstd, Init: "init.sh"}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if err := checkCpioOutput(&OutputV1{Type: OutputTypeCpio, Compression: "bzip2"}); err == nil {
+		t.Error("expected error for unsupported compression")
+	}
+
+	if err := checkCpioOutput(&OutputV1{Type: OutputTypeCpio, Init: "/init.sh"}); err == nil {
+		t.Error("expected error for absolute init path")
+	}
+}
+
+func TestSplitDevice(t *testing.T) {
+	// makedev(259, 65536)
+	major, minor := splitDevice(0x10010300)
+	if major != 259 || minor != 65536 {
+		t.Errorf("expected 259:65536, got %d:%d", major, minor)
+	}
+}
+
+func TestWriteCpioArchive(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "bin", "busybox"), []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(rootfs, "bin", "busybox"), filepath.Join(rootfs, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/busybox", filepath.Join(rootfs, "linuxrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "init"), []byte("rootfs init"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Device nodes require CAP_MKNOD
+	hasDevice := syscall.Mknod(filepath.Join(rootfs, "console"), syscall.S_IFCHR|0600, 5<<8|1) == nil
+
+	initPath := filepath.Join(t.TempDir(), "init.sh")
+	if err := os.WriteFile(initPath, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCpioArchive(&buf, rootfs, initPath); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	entries := readTestCpio(t, buf.Bytes())
+
+	busybox, sh := entries["bin/busybox"], entries["bin/sh"]
+	if busybox.hdr.Ino != sh.hdr.Ino || busybox.hdr.Nlink != 2 || sh.hdr.Nlink != 2 {
+		t.Errorf("expected hardlinks to share an inode, got %+v and %+v", busybox.hdr, sh.hdr)
+	}
+	if busybox.data != "" || sh.data != "busybox" {
+		t.Errorf("expected only the last link to carry data, got '%s' and '%s'", busybox.data, sh.data)
+	}
+
+	linuxrc := entries["linuxrc"]
+	if linuxrc.hdr.Mode&syscall.S_IFMT != syscall.S_IFLNK || linuxrc.data != "bin/busybox" {
+		t.Errorf("expected symlink to bin/busybox, got mode %o and '%s'", linuxrc.hdr.Mode, linuxrc.data)
+	}
+
+	init := entries["init"]
+	if init.data != "#!/bin/sh\n" || init.hdr.Mode != syscall.S_IFREG|0755 || init.hdr.UID != 0 {
+		t.Errorf("expected init to be replaced, got mode %o and '%s'", init.hdr.Mode, init.data)
+	}
+
+	if hasDevice {
+		console := entries["console"]
+		if console.hdr.Mode&syscall.S_IFMT != syscall.S_IFCHR || console.hdr.RdevMajor != 5 || console.hdr.RdevMinor != 1 {
+			t.Errorf("expected character device 5:1, got %+v", console.hdr)
+		}
+	}
+}
+
+func TestNewCompressorGzip(t *testing.T) {
+	var buf bytes.Buffer
+	compressor, err := newTestRootfsBuilder(t).newCompressor(&buf, CompressionGzip)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err = compressor.Write([]byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	if err = compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("expected gzip stream, got: %s", err)
+	}
+	var out bytes.Buffer
+	if _, err = out.ReadFrom(reader); err != nil || out.String() != "payload" {
+		t.Errorf("expected 'payload', got '%s' (%v)", out.String(), err)
+	}
+}
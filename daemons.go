@@ -0,0 +1,241 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	PolicyRcdPath      = "/usr/sbin/policy-rc.d"
+	DpkgDiversionsPath = "/var/lib/dpkg/diversions"
+	DpkgInfoDir        = "/var/lib/dpkg/info"
+	// Suffix of diverted files, as used by dpkg-divert --rename
+	DivertedSuffix = ".distrib"
+	// Owner of local diversions in the dpkg database
+	DpkgLocalPackage = ":"
+)
+
+// Denies all service actions requested through invoke-rc.d and
+// deb-systemd-invoke
+const policyRcd = `#!/bin/sh
+# Installed by rootfsbuilder while the rootfs is built
+exit 101
+`
+
+// Replaces start-stop-daemon and systemctl while the rootfs is built
+const fakeDaemonControl = `#!/bin/sh
+echo "rootfsbuilder: not running '$0 $*' while the rootfs is built" >&2
+exit 0
+`
+
+// An entry of the dpkg diversions database
+type diversion struct {
+	Path     string
+	DivertTo string
+	Package  string
+}
+
+// Parses the dpkg diversions database, which lists each diversion as three
+// lines: the diverted path, the new path, and the owning package
+func parseDiversions(data []byte) ([]diversion, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines)%3 != 0 {
+		return nil, fmt.Errorf("malformed diversions database: %d lines", len(lines))
+	}
+
+	diversions := make([]diversion, 0, len(lines)/3)
+	for i := 0; i < len(lines); i += 3 {
+		diversions = append(diversions, diversion{Path: lines[i], DivertTo: lines[i+1], Package: lines[i+2]})
+	}
+
+	return diversions, nil
+}
+
+func formatDiversions(diversions []diversion) []byte {
+	var buf bytes.Buffer
+	for _, d := range diversions {
+		fmt.Fprintf(&buf, "%s\n%s\n%s\n", d.Path, d.DivertTo, d.Package)
+	}
+	return buf.Bytes()
+}
+
+func (b *Builder) readDiversions() ([]diversion, error) {
+	data, err := os.ReadFile(b.rootfs + DpkgDiversionsPath)
+	if os.IsNotExist(err) {
+		return []diversion{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return parseDiversions(data)
+}
+
+func (b *Builder) writeDiversions(diversions []diversion) error {
+	return os.WriteFile(b.rootfs+DpkgDiversionsPath, formatDiversions(diversions), 0644)
+}
+
+// Returns the path of an executable in the file list of an installed
+// package, or an empty string if the package or executable is missing.
+func (b *Builder) findPackageExecutable(pkg string, name string) (string, error) {
+	lists := []string{
+		path.Join(b.rootfs, DpkgInfoDir, pkg+".list"),
+		path.Join(b.rootfs, DpkgInfoDir, pkg+":"+b.config.Architecture+".list"),
+	}
+
+	for _, list := range lists {
+		data, err := os.ReadFile(list)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("error while reading file list of package '%s': %w", pkg, err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if path.Base(line) == name && strings.HasSuffix(path.Dir(line), "bin") {
+				return line, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// Diverts an executable in the rootfs, like dpkg-divert --local --rename,
+// and replaces it with a script that does nothing. Packages installed or
+// upgraded meanwhile place the real executable at the diverted path. The
+// returned function removes the diversion again.
+func (b *Builder) divertExecutable(file string) (func() error, error) {
+	diversions, err := b.readDiversions()
+	if err != nil {
+		return nil, fmt.Errorf("error while reading diversions: %w", err)
+	}
+
+	for _, d := range diversions {
+		if d.Path == file {
+			// Diverted by the rootfs itself, leave as is
+			return func() error { return nil }, nil
+		}
+	}
+
+	original := b.rootfs + file
+	diverted := original + DivertedSuffix
+	if _, err = os.Lstat(original); err == nil {
+		if err = os.Rename(original, diverted); err != nil {
+			return nil, fmt.Errorf("error while diverting '%s': %w", file, err)
+		}
+	}
+
+	diversions = append(diversions, diversion{Path: file, DivertTo: file + DivertedSuffix, Package: DpkgLocalPackage})
+	if err = b.writeDiversions(diversions); err != nil {
+		return nil, fmt.Errorf("error while adding diversion of '%s': %w", file, err)
+	}
+
+	if err = os.WriteFile(original, []byte(fakeDaemonControl), 0755); err != nil {
+		return nil, fmt.Errorf("error while replacing '%s': %w", file, err)
+	}
+
+	return func() error {
+		if err := os.Remove(original); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error while removing replacement of '%s': %w", file, err)
+		}
+		if _, err := os.Lstat(diverted); err == nil {
+			if err = os.Rename(diverted, original); err != nil {
+				return fmt.Errorf("error while restoring '%s': %w", file, err)
+			}
+		}
+
+		// The database may have been changed by the post install command
+		diversions, err := b.readDiversions()
+		if err != nil {
+			return fmt.Errorf("error while reading diversions: %w", err)
+		}
+		kept := diversions[:0]
+		for _, d := range diversions {
+			if d.Path != file || d.Package != DpkgLocalPackage {
+				kept = append(kept, d)
+			}
+		}
+		return b.writeDiversions(kept)
+	}, nil
+}
+
+// Prevents package maintainer scripts run in the chroot from starting
+// services on the build host: a policy-rc.d denies all service actions,
+// and start-stop-daemon and systemctl are diverted. Everything is
+// registered on the teardown stack. The returned function restores the
+// rootfs. Root filesystems without dpkg (e.g. Alpine Linux) are left as
+// is, as their package managers do not start services in a chroot.
+func (b *Builder) preventDaemons() (func() error, error) {
+	if _, err := os.Stat(b.rootfs + DpkgInfoDir); os.IsNotExist(err) {
+		return func() error { return nil }, nil
+	}
+
+	releases := []func() error{}
+	restore := func() error {
+		var firstErr error
+		for i := len(releases) - 1; i >= 0; i-- {
+			if err := releases[i](); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+
+	release, err := b.injectContent(PolicyRcdPath, []byte(policyRcd), 0755)
+	if err != nil {
+		return nil, err
+	}
+	releases = append(releases, release)
+
+	// Part of every rootfs
+	startStopDaemon, err := b.findPackageExecutable("dpkg", "start-stop-daemon")
+	if err != nil {
+		_ = restore()
+		return nil, err
+	}
+	if startStopDaemon == "" {
+		startStopDaemon = "/sbin/start-stop-daemon"
+	}
+
+	executables := []string{startStopDaemon}
+
+	// Only diverted if installed. Without systemd running, it does not
+	// start services anyway.
+	systemctl, err := b.findPackageExecutable("systemd", "systemctl")
+	if err != nil {
+		_ = restore()
+		return nil, err
+	}
+	if systemctl != "" {
+		executables = append(executables, systemctl)
+	}
+
+	for _, executable := range executables {
+		release, err := b.divertExecutable(executable)
+		if err != nil {
+			_ = restore()
+			return nil, err
+		}
+		releases = append(releases, b.teardown.Push("remove diversion of "+executable, release))
+	}
+
+	return restore, nil
+}
@@ -0,0 +1,113 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseDiversions(t *testing.T) {
+	data := "/usr/bin/ischroot\n/usr/bin/ischroot.debianutils\ndebianutils\n/sbin/start-stop-daemon\n/sbin/start-stop-daemon.distrib\n:\n"
+
+	diversions, err := parseDiversions([]byte(data))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(diversions) != 2 || diversions[1].Package != DpkgLocalPackage || diversions[0].DivertTo != "/usr/bin/ischroot.debianutils" {
+		t.Errorf("unexpected diversions: %+v", diversions)
+	}
+	if string(formatDiversions(diversions)) != data {
+		t.Errorf("expected formatting to round-trip, got: %q", formatDiversions(diversions))
+	}
+
+	if _, err = parseDiversions([]byte("/usr/bin/ischroot\n")); err == nil {
+		t.Error("expected error for truncated database")
+	}
+}
+
+func TestPreventDaemons(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	rootfs := builder.rootfs
+
+	for _, dir := range []string{"/sbin", "/bin", "/usr/sbin", DpkgInfoDir} {
+		if err := os.MkdirAll(rootfs+dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		"/sbin/start-stop-daemon":     "real start-stop-daemon",
+		"/bin/systemctl":              "real systemctl",
+		PolicyRcdPath:                 "#!/bin/sh\nexit 0\n",
+		DpkgInfoDir + "/dpkg.list":    "/.\n/sbin\n/sbin/start-stop-daemon\n/usr/share/man/man8/start-stop-daemon.8.gz\n",
+		DpkgInfoDir + "/systemd.list": "/.\n/bin\n/bin/systemctl\n",
+		DpkgDiversionsPath:            "/usr/bin/ischroot\n/usr/bin/ischroot.debianutils\ndebianutils\n",
+	}
+	for file, content := range files {
+		if err := os.WriteFile(rootfs+file, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restore, err := builder.preventDaemons()
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if data, _ := os.ReadFile(rootfs + PolicyRcdPath); !strings.Contains(string(data), "exit 101") {
+		t.Errorf("expected denying policy-rc.d, got: %q", data)
+	}
+	for _, file := range []string{"/sbin/start-stop-daemon", "/bin/systemctl"} {
+		if data, _ := os.ReadFile(rootfs + file); string(data) != fakeDaemonControl {
+			t.Errorf("expected '%s' to be replaced", file)
+		}
+		if _, err = os.Stat(rootfs + file + DivertedSuffix); err != nil {
+			t.Errorf("expected '%s' to be diverted", file)
+		}
+	}
+	diversions, err := builder.readDiversions()
+	if err != nil || len(diversions) != 3 {
+		t.Fatalf("expected 3 diversions, got: %+v, %v", diversions, err)
+	}
+
+	// Added by a package installed in the post install command
+	diversions = append(diversions, diversion{Path: "/usr/bin/foo", DivertTo: "/usr/bin/foo.real", Package: "foo"})
+	if err = builder.writeDiversions(diversions); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = restore(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	for _, file := range []string{"/sbin/start-stop-daemon", "/bin/systemctl", PolicyRcdPath} {
+		if data, _ := os.ReadFile(rootfs + file); string(data) != files[file] {
+			t.Errorf("expected '%s' to be restored, got: %q", file, data)
+		}
+	}
+	data, _ := os.ReadFile(rootfs + DpkgDiversionsPath)
+	expected := files[DpkgDiversionsPath] + "/usr/bin/foo\n/usr/bin/foo.real\nfoo\n"
+	if string(data) != expected {
+		t.Errorf("expected only the builder's diversions to be removed, got: %q", data)
+	}
+}
+
+func TestPreventDaemonsWithoutDpkg(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	restore, err := builder.preventDaemons()
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err = os.Lstat(builder.rootfs + PolicyRcdPath); !os.IsNotExist(err) {
+		t.Error("expected no policy-rc.d without dpkg")
+	}
+	if err = restore(); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
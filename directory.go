@@ -0,0 +1,173 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Relative paths are resolved against the working directory
+	atFdcwd = -0x64
+	// Atomically exchange two paths (renameat2 flag)
+	renameExchange = 0x2
+)
+
+var (
+	// Numbers of the renameat2 syscall, which is missing from the syscall
+	// package on most architectures.
+	renameat2Syscalls = map[string]uintptr{
+		"amd64":    316,
+		"386":      353,
+		"arm":      382,
+		"arm64":    276,
+		"loong64":  276,
+		"riscv64":  276,
+		"mips":     4351,
+		"mipsle":   4351,
+		"mips64":   5311,
+		"mips64le": 5311,
+		"ppc64":    357,
+		"ppc64le":  357,
+		"s390x":    347,
+	}
+
+	errExchangeUnsupported = errors.New("atomic exchange is not supported")
+)
+
+func checkDirectoryOutput(output *OutputV1) error {
+	if output.Target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if !path.IsAbs(output.Target) {
+		return fmt.Errorf("target '%s' is not absolute", output.Target)
+	}
+	if path.Clean(output.Target) == "/" {
+		return fmt.Errorf("target must not be the root directory")
+	}
+
+	if output.Mode != "" && output.Mode != DirectoryModeCopy && output.Mode != DirectoryModeMove {
+		return fmt.Errorf("unsupported mode '%s'", output.Mode)
+	}
+
+	return nil
+}
+
+// Atomically exchanges two paths, which must be on the same filesystem
+func exchangePaths(oldPath string, newPath string) error {
+	nr, ok := renameat2Syscalls[runtime.GOARCH]
+	if !ok {
+		return errExchangeUnsupported
+	}
+
+	oldPtr, err := syscall.BytePtrFromString(oldPath)
+	if err != nil {
+		return err
+	}
+	newPtr, err := syscall.BytePtrFromString(newPath)
+	if err != nil {
+		return err
+	}
+
+	fdcwd := atFdcwd
+	_, _, errno := syscall.Syscall6(nr, uintptr(fdcwd), uintptr(unsafe.Pointer(oldPtr)),
+		uintptr(fdcwd), uintptr(unsafe.Pointer(newPtr)), renameExchange, 0)
+	switch errno {
+	case 0:
+		return nil
+	case syscall.ENOSYS, syscall.EINVAL:
+		// Old kernel, or the filesystem does not support the flag
+		return errExchangeUnsupported
+	}
+
+	return &os.LinkError{Op: "renameat2", Old: oldPath, New: newPath, Err: errno}
+}
+
+// Places the rootfs in the output's target directory. The new tree is
+// assembled next to the target, so that it can be renamed into place. An
+// existing target is swapped out atomically, if replacing is enabled.
+func (b *Builder) buildDirectory(output *OutputV1) error {
+	target := path.Clean(output.Target)
+
+	_, err := os.Lstat(target)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error while checking target: %w", err)
+	}
+	if exists && !output.Replace {
+		return fmt.Errorf("target '%s' already exists", target)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("error while creating parent directory: %w", err)
+	}
+
+	// Staged next to the target, as renaming only works within a filesystem
+	workDir, removeWorkDir, err := b.makeTempDir(filepath.Dir(target), "."+filepath.Base(target)+".rootfsbuilder-")
+	if err != nil {
+		return err
+	}
+	defer removeWorkDir()
+
+	staged := workDir + "/rootfs"
+	if err = b.stageDirectory(output.Mode, staged); err != nil {
+		return err
+	}
+
+	if !exists {
+		if err = os.Rename(staged, target); err != nil {
+			return fmt.Errorf("error while renaming into target: %w", err)
+		}
+		return nil
+	}
+
+	// After the exchange, the previous tree is in the staging directory
+	// and removed with it.
+	err = exchangePaths(staged, target)
+	if err == nil {
+		return nil
+	}
+	if err != errExchangeUnsupported {
+		return fmt.Errorf("error while exchanging target: %w", err)
+	}
+
+	fmt.Fprintf(b.loggerErr, "Atomic exchange is not supported, replacing '%s' with two renames\n", target)
+	if err = os.Rename(target, workDir+"/previous"); err != nil {
+		return fmt.Errorf("error while moving previous target: %w", err)
+	}
+	if err = os.Rename(staged, target); err != nil {
+		return fmt.Errorf("error while renaming into target: %w", err)
+	}
+
+	return nil
+}
+
+// Copies or moves the rootfs to stagePath. Moving falls back to copying if
+// the rootfs is on a different filesystem.
+func (b *Builder) stageDirectory(mode string, stagePath string) error {
+	if mode == DirectoryModeMove {
+		err := os.Rename(b.rootfs, stagePath)
+		if err == nil {
+			return nil
+		}
+
+		var linkErr *os.LinkError
+		if !errors.As(err, &linkErr) || linkErr.Err != syscall.EXDEV {
+			return fmt.Errorf("error while moving rootfs: %w", err)
+		}
+		fmt.Fprintf(b.loggerErr, "Target is on a different filesystem, copying rootfs\n")
+	}
+
+	return b.copyTree(b.rootfs, stagePath, false)
+}
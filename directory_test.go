@@ -0,0 +1,135 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDirectoryOutput(t *testing.T) {
+	if err := checkDirectoryOutput(&OutputV1{Type: OutputTypeDirectory, Target: "/srv/nfs/board", Mode: DirectoryModeMove}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if err := checkDirectoryOutput(&OutputV1{Type: OutputTypeDirectory}); err == nil {
+		t.Error("expected error for missing target")
+	}
+
+	if err := checkDirectoryOutput(&OutputV1{Type: OutputTypeDirectory, Target: "srv/nfs"}); err == nil {
+		t.Error("expected error for relative target")
+	}
+
+	if err := checkDirectoryOutput(&OutputV1{Type: OutputTypeDirectory, Target: "/"}); err == nil {
+		t.Error("expected error for root target")
+	}
+
+	if err := checkDirectoryOutput(&OutputV1{Type: OutputTypeDirectory, Target: "/srv/nfs", Mode: "link"}); err == nil {
+		t.Error("expected error for unsupported mode")
+	}
+}
+
+func TestCheckMovedDirectoryIsLast(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	config := builder.config
+
+	config.Outputs = []OutputV1{
+		{Type: OutputTypeDirectory, Target: "/srv/nfs/board", Mode: DirectoryModeMove},
+		{Type: OutputTypeSquashfs},
+	}
+	if err := checkRequiredFields(config); err == nil {
+		t.Error("expected error for moving the rootfs before another output")
+	}
+
+	config.Outputs[0], config.Outputs[1] = config.Outputs[1], config.Outputs[0]
+	if err := checkRequiredFields(config); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
+
+func TestBuildDirectoryCopy(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	target := filepath.Join(t.TempDir(), "nfs", "board")
+	output := &OutputV1{Type: OutputTypeDirectory, Target: target}
+
+	if err := builder.buildDirectory(output); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if data, err := os.ReadFile(target + "/etc/hostname"); err != nil || string(data) != "rootfsbuilder\n" {
+		t.Errorf("expected rootfs in target, got: %v", err)
+	}
+	if _, err := os.Stat(builder.rootfs + "/etc/hostname"); err != nil {
+		t.Errorf("expected rootfs to be kept when copying, got: %s", err)
+	}
+
+	if err := builder.buildDirectory(output); err == nil {
+		t.Error("expected error for existing target without replace")
+	}
+}
+
+func TestBuildDirectoryReplace(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	parent := t.TempDir()
+	target := filepath.Join(parent, "board")
+
+	if err := os.MkdirAll(target+"/etc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target+"/etc/stale", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &OutputV1{Type: OutputTypeDirectory, Target: target, Mode: DirectoryModeMove, Replace: true}
+	if err := builder.buildDirectory(output); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if _, err := os.Stat(target + "/etc/hostname"); err != nil {
+		t.Errorf("expected new rootfs in target, got: %s", err)
+	}
+	if _, err := os.Stat(target + "/etc/stale"); !os.IsNotExist(err) {
+		t.Error("expected previous tree to be replaced")
+	}
+	if _, err := os.Stat(builder.rootfs); !os.IsNotExist(err) {
+		t.Error("expected rootfs to be moved")
+	}
+
+	// Only the target remains, the staging directory is removed
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "board" {
+		t.Errorf("expected only the target in the parent directory, got %d entries", len(entries))
+	}
+}
+
+func TestExchangePaths(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := exchangePaths(dir+"/a", dir+"/b")
+	if err == errExchangeUnsupported {
+		t.Skip("atomic exchange is not supported")
+	} else if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if info, err := os.Stat(dir + "/a"); err != nil || !info.IsDir() {
+		t.Error("expected directory at 'a' after the exchange")
+	}
+	if data, err := os.ReadFile(dir + "/b"); err != nil || string(data) != "a" {
+		t.Error("expected file at 'b' after the exchange")
+	}
+}
@@ -0,0 +1,504 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var (
+	binarySizeSuffixes = map[string]uint64{
+		"":  1,
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+)
+
+// Parses a size in bytes with an optional binary suffix (K, M, G, T).
+// "512M" and "512MiB" are equivalent.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "IB")
+
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+
+	multiplier, ok := binarySizeSuffixes[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown size suffix in '%s'", s)
+	}
+
+	value, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed size '%s'", s)
+	}
+	if value > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("size '%s' is too large", s)
+	}
+
+	return value * multiplier, nil
+}
+
+func alignUp(value uint64, alignment uint64) uint64 {
+	return (value + alignment - 1) / alignment * alignment
+}
+
+func checkDiskOutput(output *OutputV1) error {
+	if output.PartitionTable != PartitionTableGPT && output.PartitionTable != PartitionTableMBR {
+		return fmt.Errorf("unsupported partition table type: '%s'", output.PartitionTable)
+	}
+
+	if len(output.Partitions) == 0 {
+		return fmt.Errorf("disk image requires at least one partition")
+	}
+
+	if output.PartitionTable == PartitionTableMBR && len(output.Partitions) > 4 {
+		return fmt.Errorf("mbr partition table supports at most 4 partitions")
+	}
+
+	// Each format is written to the same path
+	formats := map[string]bool{}
+	for i := range output.Convert {
+		if err := checkConversion(&output.Convert[i]); err != nil {
+			return err
+		}
+		if formats[output.Convert[i].Format] {
+			return fmt.Errorf("duplicate conversion to '%s'", output.Convert[i].Format)
+		}
+		formats[output.Convert[i].Format] = true
+	}
+
+	mountPoints := map[string]bool{}
+	for i, p := range output.Partitions {
+		size, err := parseSize(p.Size)
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", i+1, err)
+		}
+		if size == 0 {
+			return fmt.Errorf("partition %d: size is required", i+1)
+		}
+
+		if output.PartitionTable == PartitionTableGPT {
+			_, err = GPTPartitionType(p.Type)
+		} else {
+			_, err = MBRPartitionType(p.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("partition %d: %w", i+1, err)
+		}
+
+		switch p.Filesystem {
+		case FilesystemExt2, FilesystemExt3, FilesystemExt4:
+		case FilesystemVfat, FilesystemFat16, FilesystemFat32:
+			if err = checkFatLabel(p.Name); err != nil {
+				return fmt.Errorf("partition %d: %w", i+1, err)
+			}
+		case FilesystemSwap, FilesystemNone:
+			if p.MountPoint != "" || p.Source != "" {
+				return fmt.Errorf("partition %d: filesystem '%s' cannot have a mount point or source", i+1, p.Filesystem)
+			}
+		default:
+			return fmt.Errorf("partition %d: unsupported filesystem '%s'", i+1, p.Filesystem)
+		}
+
+		if p.MountPoint != "" {
+			if !path.IsAbs(p.MountPoint) {
+				return fmt.Errorf("partition %d: mount point '%s' is not absolute", i+1, p.MountPoint)
+			}
+			if mountPoints[path.Clean(p.MountPoint)] {
+				return fmt.Errorf("partition %d: duplicate mount point '%s'", i+1, p.MountPoint)
+			}
+			mountPoints[path.Clean(p.MountPoint)] = true
+		}
+
+		if p.Source != "" {
+			if !path.IsAbs(p.Source) {
+				return fmt.Errorf("partition %d: source '%s' is not absolute", i+1, p.Source)
+			}
+			for _, component := range strings.Split(p.Source, "/") {
+				if component == ".." {
+					return fmt.Errorf("partition %d: source must not contain '..': '%s'", i+1, p.Source)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Computes the partition layout. Partitions are placed in order, each
+// aligned to 1 MiB. Partition and disk identifiers are randomly generated.
+func newPartitionTable(output *OutputV1) (*PartitionTable, error) {
+	var err error
+	table := &PartitionTable{Type: output.PartitionTable}
+
+	if table.DiskGUID, err = NewRandomGUID(); err != nil {
+		return nil, err
+	}
+	table.Signature = binary.LittleEndian.Uint32(table.DiskGUID[12:])
+
+	alignment := uint64(PartitionAlignment / SectorSize)
+	lba := alignment
+
+	for _, p := range output.Partitions {
+		size, err := parseSize(p.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := PartitionEntry{
+			Name:     p.Name,
+			StartLBA: lba,
+			Sectors:  alignUp(size, SectorSize) / SectorSize,
+			Bootable: p.Bootable,
+		}
+
+		if table.Type == PartitionTableGPT {
+			if entry.TypeGUID, err = GPTPartitionType(p.Type); err != nil {
+				return nil, err
+			}
+			if entry.UUID, err = NewRandomGUID(); err != nil {
+				return nil, err
+			}
+		} else {
+			if entry.TypeID, err = MBRPartitionType(p.Type); err != nil {
+				return nil, err
+			}
+		}
+
+		table.Partitions = append(table.Partitions, entry)
+		lba = alignUp(lba+entry.Sectors, alignment)
+	}
+
+	table.Sectors = lba
+	if table.Type == PartitionTableGPT {
+		// Leave room for the backup GPT
+		table.Sectors += alignment
+	}
+
+	return table, nil
+}
+
+// Generates an fstab referencing the partitions by PARTUUID.
+func generateFstab(output *OutputV1, table *PartitionTable) string {
+	var buf strings.Builder
+
+	buf.WriteString("# /etc/fstab: static file system information.\n")
+	buf.WriteString("# Generated by rootfsbuilder\n")
+	buf.WriteString("#\n")
+	buf.WriteString("# <file system> <mount point> <type> <options> <dump> <pass>\n")
+
+	for i, p := range output.Partitions {
+		options := p.MountOptions
+		if options == "" {
+			options = "defaults"
+		}
+
+		switch {
+		case p.Filesystem == FilesystemSwap:
+			if p.MountOptions == "" {
+				options = "sw"
+			}
+			fmt.Fprintf(&buf, "PARTUUID=%s none swap %s 0 0\n", table.PartUUID(i), options)
+		case p.MountPoint != "":
+			pass := 2
+			if path.Clean(p.MountPoint) == "/" {
+				pass = 1
+			}
+			fmt.Fprintf(&buf, "PARTUUID=%s %s %s %s 0 %d\n", table.PartUUID(i), path.Clean(p.MountPoint), fstabType(p.Filesystem), options, pass)
+		}
+	}
+
+	return buf.String()
+}
+
+// Returns the filesystem type as understood by mount
+func fstabType(filesystem string) string {
+	if fatSizeOf(filesystem) != 0 {
+		return FilesystemVfat
+	}
+
+	return filesystem
+}
+
+// Builds a raw disk image from the rootfs. Every filesystem is built as a
+// separate image file, and then copied into the disk image at the partition
+// offset, so that no loop devices are required.
+func (b *Builder) buildDiskImage(output *OutputV1, imagePath string) error {
+	table, err := newPartitionTable(output)
+	if err != nil {
+		return fmt.Errorf("error while computing partition layout: %w", err)
+	}
+
+	workDir, removeWorkDir, err := b.makeTempDir(os.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		return err
+	}
+	defer removeWorkDir()
+
+	fstab := generateFstab(output, table)
+	images := make([]string, len(output.Partitions))
+
+	for i, p := range output.Partitions {
+		if p.Filesystem == FilesystemNone {
+			continue
+		}
+
+		partitionImage := fmt.Sprintf("%s/partition%d.img", workDir, i+1)
+		sizeBytes := table.Partitions[i].Sectors * SectorSize
+
+		if p.Filesystem == FilesystemSwap {
+			if err = b.makeSwap(partitionImage, sizeBytes, p.Name); err != nil {
+				return fmt.Errorf("error while creating swap for partition %d: %w", i+1, err)
+			}
+			images[i] = partitionImage
+			continue
+		}
+
+		stageDir := fmt.Sprintf("%s/partition%d", workDir, i+1)
+		if err = b.stagePartition(output, i, stageDir); err != nil {
+			return fmt.Errorf("error while staging partition %d: %w", i+1, err)
+		}
+
+		if path.Clean(p.MountPoint) == "/" {
+			if err = replaceFile(stageDir+"/etc/fstab", []byte(fstab), 0644); err != nil {
+				return fmt.Errorf("error while writing fstab: %w", err)
+			}
+		}
+
+		fmt.Fprintf(b.loggerErr, "Creating %s filesystem for partition %d\n", p.Filesystem, i+1)
+		if fstabType(p.Filesystem) == FilesystemVfat {
+			err = b.makeFatFilesystem(stageDir, nil, partitionImage, sizeBytes, fatSizeOf(p.Filesystem), p.Name)
+		} else {
+			err = b.makeExtFilesystem(p.Filesystem, stageDir, partitionImage, sizeBytes, p.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("error while creating filesystem for partition %d: %w", i+1, err)
+		}
+		images[i] = partitionImage
+
+		// Free the staging tree early
+		os.RemoveAll(stageDir)
+	}
+
+	fd, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("error while creating disk image: %w", err)
+	}
+	defer fd.Close()
+
+	if err = fd.Truncate(int64(table.Sectors * SectorSize)); err != nil {
+		return fmt.Errorf("error while resizing disk image: %w", err)
+	}
+
+	if err = table.WriteTo(fd); err != nil {
+		return fmt.Errorf("error while writing partition table: %w", err)
+	}
+
+	for i, image := range images {
+		if image == "" {
+			continue
+		}
+
+		offset := int64(table.Partitions[i].StartLBA * SectorSize)
+		if err = copyIntoImage(fd, image, offset); err != nil {
+			return fmt.Errorf("error while writing partition %d into disk image: %w", i+1, err)
+		}
+	}
+
+	return fd.Close()
+}
+
+// Creates a hardlinked copy of the partition's rootfs subtree. Subtrees of
+// other partitions that are mounted below this partition are left empty.
+func (b *Builder) stagePartition(output *OutputV1, index int, stageDir string) error {
+	p := output.Partitions[index]
+
+	source := path.Clean(p.Source)
+	if p.Source == "" {
+		source = p.MountPoint
+	}
+	if source == "" {
+		source = "/"
+	}
+
+	excluded := []string{}
+	if p.MountPoint != "" {
+		mountPoint := path.Clean(p.MountPoint)
+		for i, other := range output.Partitions {
+			if i == index || other.MountPoint == "" {
+				continue
+			}
+
+			rel, ok := relativeSubpath(mountPoint, path.Clean(other.MountPoint))
+			if ok {
+				excluded = append(excluded, rel)
+			}
+		}
+	}
+
+	if err := b.copyTree(path.Join(b.rootfs, source), stageDir, true); err != nil {
+		return err
+	}
+
+	for _, rel := range excluded {
+		dir := path.Join(stageDir, rel)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if err = os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("error while removing '%s' from staging tree: %w", rel, err)
+		}
+		// Keep an empty mount point
+		if err = os.Mkdir(dir, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("error while creating mount point '%s': %w", rel, err)
+		}
+	}
+
+	return nil
+}
+
+// Copies a directory tree, preserving attributes. With link, files are
+// hardlinked instead of copied, which requires the destination to be on
+// the same filesystem as the source.
+func (b *Builder) copyTree(source string, dest string, link bool) error {
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return fmt.Errorf("error while creating directory: %w", err)
+	}
+
+	args := []string{"-a"}
+	if link {
+		args = append(args, "--link")
+	}
+	args = append(args, source+"/.", dest)
+
+	cmd := exec.Command("cp", args...)
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while copying '%s': %w", source, err)
+	}
+
+	return nil
+}
+
+func (b *Builder) makeExtFilesystem(filesystem string, sourceDir string, imagePath string, sizeBytes uint64, label string) error {
+	args := []string{"-q", "-F", "-t", filesystem, "-d", sourceDir}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	args = append(args, imagePath, fmt.Sprintf("%dk", sizeBytes/1024))
+
+	cmd := exec.Command("mke2fs", args...)
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while running mke2fs: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Builder) makeSwap(imagePath string, sizeBytes uint64, label string) error {
+	fd, err := os.Create(imagePath)
+	if err != nil {
+		return err
+	}
+	err = fd.Truncate(int64(sizeBytes))
+	fd.Close()
+	if err != nil {
+		return err
+	}
+
+	args := []string{}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	args = append(args, imagePath)
+
+	cmd := exec.Command("mkswap", args...)
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	if err = b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while running mkswap: %w", err)
+	}
+
+	return nil
+}
+
+// Copies the image into the disk at the given offset. All-zero blocks are
+// skipped to keep the disk image sparse.
+func copyIntoImage(disk *os.File, imagePath string, offset int64) error {
+	fd, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, 1024*1024)
+	zero := make([]byte, len(buf))
+
+	for {
+		n, err := io.ReadFull(fd, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, werr := disk.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+		}
+		offset += int64(n)
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Replaces a file instead of writing through it. This breaks hardlinks
+// and symlinks.
+func replaceFile(filePath string, data []byte, perm os.FileMode) error {
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.WriteFile(filePath, data, perm)
+}
+
+// Returns the path of target relative to base, if target is below base.
+func relativeSubpath(base string, target string) (string, bool) {
+	if base == target {
+		return "", false
+	}
+	if base == "/" {
+		return strings.TrimPrefix(target, "/"), true
+	}
+	if strings.HasPrefix(target, base+"/") {
+		return strings.TrimPrefix(target, base+"/"), true
+	}
+
+	return "", false
+}
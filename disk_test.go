@@ -0,0 +1,140 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]uint64{
+		"4096":   4096,
+		"64K":    64 * 1024,
+		"512M":   512 * 1024 * 1024,
+		"512MiB": 512 * 1024 * 1024,
+		"2g":     2 * 1024 * 1024 * 1024,
+	}
+
+	for s, expected := range sizes {
+		size, err := parseSize(s)
+		if err != nil {
+			t.Errorf("expected no error while parsing '%s', got: %s", s, err)
+		}
+		if size != expected {
+			t.Errorf("expected '%s' to be %d bytes, got: %d", s, expected, size)
+		}
+	}
+
+	for _, s := range []string{"", "M", "12X", "1.5G", "99999999999T", "18446744073709551616"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("expected error while parsing '%s'", s)
+		}
+	}
+}
+
+func testDiskOutput() *OutputV1 {
+	return &OutputV1{
+		Type:           OutputTypeDisk,
+		PartitionTable: PartitionTableGPT,
+		Partitions: []PartitionV1{
+			{Name: "boot", Size: "100M", Type: "linux", Filesystem: FilesystemExt4, MountPoint: "/boot"},
+			{Name: "swap", Size: "64M", Type: "swap", Filesystem: FilesystemSwap},
+			{Name: "rootfs", Size: "1G", Type: "linux", Filesystem: FilesystemExt4, MountPoint: "/"},
+		},
+	}
+}
+
+func TestCheckDiskOutput(t *testing.T) {
+	output := testDiskOutput()
+	if err := checkDiskOutput(output); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	output.Partitions[0].MountPoint = "/"
+	if err := checkDiskOutput(output); err == nil {
+		t.Error("expected error for duplicate mount points")
+	}
+
+	output = testDiskOutput()
+	output.Partitions[1].MountPoint = "/swap"
+	if err := checkDiskOutput(output); err == nil {
+		t.Error("expected error for swap partition with mount point")
+	}
+
+	output = testDiskOutput()
+	output.PartitionTable = PartitionTableMBR
+	output.Partitions[0].Type = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	if err := checkDiskOutput(output); err == nil {
+		t.Error("expected error for GPT type GUID in MBR partition table")
+	}
+
+	for _, source := range []string{"boot", "/../..", "/boot/../../etc"} {
+		output = testDiskOutput()
+		output.Partitions[0].Source = source
+		if err := checkDiskOutput(output); err == nil {
+			t.Errorf("expected error for source '%s'", source)
+		}
+	}
+}
+
+func TestNewPartitionTable(t *testing.T) {
+	table, err := newPartitionTable(testDiskOutput())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	alignment := uint64(PartitionAlignment / SectorSize)
+	for i, p := range table.Partitions {
+		if p.StartLBA%alignment != 0 {
+			t.Errorf("partition %d is not aligned: %d", i+1, p.StartLBA)
+		}
+		if i > 0 && p.StartLBA < table.Partitions[i-1].StartLBA+table.Partitions[i-1].Sectors {
+			t.Errorf("partition %d overlaps with the previous partition", i+1)
+		}
+		if p.StartLBA+p.Sectors-1 > table.LastUsableLBA() {
+			t.Errorf("partition %d exceeds the usable area", i+1)
+		}
+	}
+
+	if table.Partitions[2].Sectors != 1024*1024*1024/SectorSize {
+		t.Errorf("unexpected root partition size: %d sectors", table.Partitions[2].Sectors)
+	}
+}
+
+func TestGenerateFstab(t *testing.T) {
+	output := testDiskOutput()
+	table, err := newPartitionTable(output)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	fstab := generateFstab(output, table)
+
+	expected := []string{
+		"PARTUUID=" + table.PartUUID(0) + " /boot ext4 defaults 0 2",
+		"PARTUUID=" + table.PartUUID(1) + " none swap sw 0 0",
+		"PARTUUID=" + table.PartUUID(2) + " / ext4 defaults 0 1",
+	}
+	for _, line := range expected {
+		if !strings.Contains(fstab, line+"\n") {
+			t.Errorf("expected fstab to contain '%s', got:\n%s", line, fstab)
+		}
+	}
+}
+
+func TestRelativeSubpath(t *testing.T) {
+	if rel, ok := relativeSubpath("/", "/boot"); !ok || rel != "boot" {
+		t.Errorf("expected 'boot', got: '%s'", rel)
+	}
+	if rel, ok := relativeSubpath("/boot", "/boot/efi"); !ok || rel != "efi" {
+		t.Errorf("expected 'efi', got: '%s'", rel)
+	}
+	if _, ok := relativeSubpath("/boot", "/bootloader"); ok {
+		t.Error("expected '/bootloader' not to be below '/boot'")
+	}
+}
@@ -0,0 +1,158 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Package group installed as the base system, unless another is set
+	// as variant
+	DnfDefaultGroup = "core"
+	// Installs only the additional packages, like mmdebstrap's variant
+	VariantCustom = "custom"
+	// Name of the repository file generated for the build
+	DnfRepoFileName = "rootfsbuilder.repo"
+)
+
+// Installs RPM-based distributions with dnf --installroot. The architecture
+// is passed to --forcearch by its RPM name (e.g. armhf as armv7hl). Foreign
+// architectures require qemu-user-static registered with binfmt_misc.
+type dnf struct{}
+
+func (d *dnf) Name() string {
+	return BootstrapperDnf
+}
+
+func (d *dnf) Check(spec *BootstrapSpec) error {
+	if _, err := DebToRPMArch(spec.Architecture); err != nil {
+		return err
+	}
+	if len(spec.Components) > 0 {
+		return fmt.Errorf("components are not supported by dnf, configure each repository as a mirror")
+	}
+	if spec.Variant == VariantCustom && len(spec.Include) == 0 {
+		return fmt.Errorf("variant '%s' requires additional packages", VariantCustom)
+	}
+
+	return nil
+}
+
+// Returns the base URL of a mirror. Local directories (e.g. created with
+// createrepo) are turned into file URLs.
+func dnfBaseURL(mirror string) string {
+	if filepath.IsAbs(mirror) {
+		return "file://" + mirror
+	}
+
+	return mirror
+}
+
+// Returns the public keys the packages are verified with, from the
+// keyrings (files or directories of keys)
+func (d *dnf) keys(spec *BootstrapSpec) ([]string, error) {
+	keys, err := expandKeyrings(spec.Keyrings)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RPM signing keys, configure the key of the release as keyring")
+	}
+
+	return keys, nil
+}
+
+// Returns a repository file with a repository for each mirror. Mirrors may
+// contain the dnf variables $releasever and $basearch.
+func (d *dnf) repoFile(spec *BootstrapSpec) ([]byte, error) {
+	gpgkeys := []string{}
+	if !spec.InsecureSkipVerify {
+		keys, err := d.keys(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			absoluteKey, err := filepath.Abs(key)
+			if err != nil {
+				return nil, err
+			}
+			gpgkeys = append(gpgkeys, "file://"+absoluteKey)
+		}
+	}
+
+	var buf bytes.Buffer
+	for i, mirror := range spec.Mirrors {
+		fmt.Fprintf(&buf, "[rootfsbuilder-%d]\n", i)
+		fmt.Fprintf(&buf, "name=rootfsbuilder mirror %d\n", i)
+		fmt.Fprintf(&buf, "baseurl=%s\n", dnfBaseURL(mirror))
+		fmt.Fprintf(&buf, "enabled=1\n")
+		if spec.InsecureSkipVerify {
+			fmt.Fprintf(&buf, "gpgcheck=0\n\n")
+			continue
+		}
+		fmt.Fprintf(&buf, "gpgcheck=1\n")
+		fmt.Fprintf(&buf, "gpgkey=%s\n\n", strings.Join(gpgkeys, " "))
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (d *dnf) args(spec *BootstrapSpec, rootfs string, reposDir string) []string {
+	// Checked by Check
+	arch, _ := DebToRPMArch(spec.Architecture)
+
+	args := []string{
+		"--installroot=" + rootfs,
+		"--releasever=" + spec.Suite,
+		"--forcearch=" + arch,
+		// Only the generated repositories
+		"--setopt=reposdir=" + reposDir,
+		"--assumeyes",
+	}
+	if len(spec.Exclude) > 0 {
+		args = append(args, "--exclude="+strings.Join(spec.Exclude, ","))
+	}
+
+	args = append(args, "install")
+	switch spec.Variant {
+	case VariantCustom:
+	case "":
+		args = append(args, "@"+DnfDefaultGroup)
+	default:
+		args = append(args, "@"+spec.Variant)
+	}
+
+	return append(args, spec.Include...)
+}
+
+func (d *dnf) Bootstrap(spec *BootstrapSpec, rootfs string, env *BootstrapEnv) error {
+	repoFile, err := d.repoFile(spec)
+	if err != nil {
+		return err
+	}
+
+	// Outside of the rootfs, the installed release package brings the
+	// repositories of the finished rootfs
+	reposDir, removeReposDir, err := env.TempDir(TempDirPrefix + "repos-")
+	if err != nil {
+		return err
+	}
+	defer removeReposDir()
+
+	if err = os.WriteFile(filepath.Join(reposDir, DnfRepoFileName), repoFile, 0644); err != nil {
+		return fmt.Errorf("error while writing repository file: %w", err)
+	}
+
+	return env.Run(exec.Command("dnf", d.args(spec, rootfs, reposDir)...))
+}
@@ -0,0 +1,198 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testRockyMirror = "https://dl.rockylinux.org/pub/rocky/$releasever/BaseOS/$basearch/os/"
+
+func TestDnfCheck(t *testing.T) {
+	bootstrapper := &dnf{}
+	spec := &BootstrapSpec{Suite: "9", Architecture: "arm64", Mirrors: []string{testRockyMirror}}
+	if err := bootstrapper.Check(spec); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := map[string]BootstrapSpec{
+		"unsupported architecture":        {Suite: "9", Architecture: "mipsel"},
+		"components":                      {Suite: "9", Architecture: "amd64", Components: []string{"main"}},
+		"custom variant without packages": {Suite: "9", Architecture: "amd64", Variant: VariantCustom},
+	}
+	for name, spec := range invalid {
+		if err := bootstrapper.Check(&spec); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDnfForceArch(t *testing.T) {
+	bootstrapper := &dnf{}
+	for debArch, rpmArch := range map[string]string{"armhf": "armv7hl", "i386": "i686"} {
+		spec := &BootstrapSpec{Suite: "9", Architecture: debArch}
+		if args := bootstrapper.args(spec, "/tmp/rootfs", "/tmp/repos"); !strings.Contains(strings.Join(args, " "), " --forcearch="+rpmArch+" ") {
+			t.Errorf("expected '%s' to be installed as '%s', got: %q", debArch, rpmArch, args)
+		}
+	}
+}
+
+func TestDnfRepoFile(t *testing.T) {
+	keysDir := t.TempDir()
+	if err := os.WriteFile(keysDir+"/RPM-GPG-KEY-Rocky-9", []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &BootstrapSpec{Suite: "9", Architecture: "amd64", Mirrors: []string{testRockyMirror, "/srv/rpm"}, Keyrings: []string{keysDir}}
+	data, err := (&dnf{}).repoFile(spec)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	expected := "[rootfsbuilder-0]\nname=rootfsbuilder mirror 0\nbaseurl=" + testRockyMirror + "\nenabled=1\ngpgcheck=1\n" +
+		"gpgkey=file://" + keysDir + "/RPM-GPG-KEY-Rocky-9\n\n" +
+		"[rootfsbuilder-1]\nname=rootfsbuilder mirror 1\nbaseurl=file:///srv/rpm\nenabled=1\ngpgcheck=1\n" +
+		"gpgkey=file://" + keysDir + "/RPM-GPG-KEY-Rocky-9\n\n"
+	if string(data) != expected {
+		t.Errorf("unexpected repository file: %q", data)
+	}
+
+	spec.Keyrings = []string{t.TempDir()}
+	if _, err = (&dnf{}).repoFile(spec); err == nil {
+		t.Error("expected error without signing keys")
+	}
+
+	spec.InsecureSkipVerify = true
+	if data, err = (&dnf{}).repoFile(spec); err != nil || !strings.HasPrefix(string(data), "[rootfsbuilder-0]\nname=rootfsbuilder mirror 0\nbaseurl="+testRockyMirror+"\nenabled=1\ngpgcheck=0\n\n") {
+		t.Errorf("expected signatures not to be checked, got: %q, %v", data, err)
+	}
+}
+
+func TestDnfBootstrap(t *testing.T) {
+	keysDir := t.TempDir()
+	if err := os.WriteFile(keysDir+"/RPM-GPG-KEY-fedora", []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &BootstrapSpec{
+		Suite:        "39",
+		Architecture: "arm64",
+		Mirrors:      []string{"/srv/rpm"},
+		Include:      []string{"openssh-server", "vim-minimal"},
+		Exclude:      []string{"sssd-client", "firewalld"},
+		Keyrings:     []string{keysDir + "/RPM-GPG-KEY-fedora"},
+	}
+
+	var repoFile []byte
+	commands := []string{}
+	run := func(cmd *exec.Cmd) error {
+		commands = append(commands, strings.Join(cmd.Args, " "))
+		for _, arg := range cmd.Args {
+			if strings.HasPrefix(arg, "--setopt=reposdir=") {
+				repoFile, _ = os.ReadFile(filepath.Join(strings.TrimPrefix(arg, "--setopt=reposdir="), DnfRepoFileName))
+			}
+		}
+		return nil
+	}
+
+	bootstrapper := &dnf{}
+	if err := bootstrapper.Bootstrap(spec, "/tmp/rootfs", testBootstrapEnv(t, run)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if len(commands) != 1 || !strings.HasPrefix(commands[0], "dnf --installroot=/tmp/rootfs --releasever=39 --forcearch=aarch64 --setopt=reposdir=") ||
+		!strings.HasSuffix(commands[0], " --assumeyes --exclude=sssd-client,firewalld install @core openssh-server vim-minimal") {
+		t.Errorf("unexpected commands: %q", commands)
+	}
+	if !strings.Contains(string(repoFile), "baseurl=file:///srv/rpm\n") {
+		t.Errorf("expected repository file while dnf runs, got: %q", repoFile)
+	}
+
+	spec.Variant = VariantCustom
+	spec.Exclude = nil
+	if args := strings.Join(bootstrapper.args(spec, "/tmp/rootfs", "/tmp/repos"), " "); !strings.HasSuffix(args, "--assumeyes install openssh-server vim-minimal") {
+		t.Errorf("expected only the additional packages, got: %s", args)
+	}
+}
+
+func TestDnfReposDirRemovedOnTeardown(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	key := t.TempDir() + "/RPM-GPG-KEY-fedora"
+	if err := os.WriteFile(key, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	spec := &BootstrapSpec{Suite: "39", Architecture: "amd64", Mirrors: []string{"/srv/rpm"}, Keyrings: []string{key}}
+
+	reposDir := ""
+	env := builder.bootstrapEnv()
+	env.Run = func(cmd *exec.Cmd) error {
+		for _, arg := range cmd.Args {
+			if strings.HasPrefix(arg, "--setopt=reposdir=") {
+				reposDir = strings.TrimPrefix(arg, "--setopt=reposdir=")
+			}
+		}
+		// Like a teardown forced while dnf runs
+		return builder.teardown.Run()
+	}
+
+	if err := (&dnf{}).Bootstrap(spec, "/tmp/rootfs", env); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if reposDir == "" {
+		t.Fatal("expected repository directory")
+	}
+	if _, err := os.Stat(reposDir); !os.IsNotExist(err) {
+		t.Errorf("expected '%s' to be removed on teardown", reposDir)
+	}
+}
+
+// Bootstraps from a local repository created with createrepo, e.g.
+// ROOTFSBUILDER_TEST_DNF_MIRROR=/srv/rpm ROOTFSBUILDER_TEST_DNF_KEYS=/srv/rpm/RPM-GPG-KEY
+// ROOTFSBUILDER_TEST_DNF_PACKAGES=bash
+func TestDnfLocalRepository(t *testing.T) {
+	mirror := os.Getenv("ROOTFSBUILDER_TEST_DNF_MIRROR")
+	if mirror == "" {
+		t.Skip("ROOTFSBUILDER_TEST_DNF_MIRROR not set")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	packages := strings.Fields(os.Getenv("ROOTFSBUILDER_TEST_DNF_PACKAGES"))
+	if len(packages) == 0 {
+		packages = []string{"filesystem"}
+	}
+	keys := os.Getenv("ROOTFSBUILDER_TEST_DNF_KEYS")
+	if keys == "" {
+		t.Skip("ROOTFSBUILDER_TEST_DNF_KEYS not set")
+	}
+	spec := &BootstrapSpec{Suite: "1", Architecture: runtime.GOARCH, Mirrors: []string{mirror}, Include: packages, Variant: VariantCustom, Keyrings: []string{keys}}
+
+	bootstrapper := &dnf{}
+	if err := bootstrapper.Check(spec); err != nil {
+		t.Skipf("unsupported host: %s", err)
+	}
+
+	rootfs := t.TempDir()
+	run := func(cmd *exec.Cmd) error {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	if err := bootstrapper.Bootstrap(spec, rootfs, testBootstrapEnv(t, run)); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if _, err := os.Stat(rootfs + "/var/lib/rpm"); err != nil {
+		t.Errorf("expected RPM database in rootfs: %s", err)
+	}
+}
@@ -0,0 +1,113 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Characters not allowed in repository names and tags
+	invalidRepositoryChars = regexp.MustCompile(`[^a-z0-9._/-]+`)
+	invalidTagChars        = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	validReference         = regexp.MustCompile(`^[a-z0-9]+([._/-][a-z0-9]+)*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?$`)
+)
+
+// An entry of manifest.json as written by 'docker save'
+type dockerManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+func checkDockerOutput(output *OutputV1) error {
+	if output.Tag != "" && !validReference.MatchString(output.Tag) {
+		return fmt.Errorf("malformed image reference '%s'", output.Tag)
+	}
+
+	return checkImageConfig(&output.Image)
+}
+
+// Derives an image reference (repository:tag) from the configuration name
+// and release, e.g. "Debian Unstable" and "sid" become "debian-unstable:sid".
+func dockerReference(config *ConfigurationV1) string {
+	repository := invalidRepositoryChars.ReplaceAllString(strings.ToLower(config.Name), "-")
+	repository = strings.Trim(repository, "-._/")
+	if repository == "" {
+		repository = config.Distribution
+	}
+
+	tag := strings.TrimLeft(invalidTagChars.ReplaceAllString(config.Release, "-"), "-.")
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+
+	return repository + ":" + tag
+}
+
+// Returns the tag of an image reference, latest if it has none
+func referenceTag(reference string) string {
+	if strings.LastIndex(reference, ":") <= strings.LastIndex(reference, "/") {
+		return "latest"
+	}
+
+	return reference[strings.LastIndex(reference, ":")+1:]
+}
+
+// Builds an archive that can be loaded with 'docker load' and 'podman load'.
+// The archive contains an OCI image layout, as well as the manifest.json
+// used by the docker archive format.
+func (b *Builder) buildDockerArchive(output *OutputV1, archivePath string) error {
+	reference := output.Tag
+	if reference == "" {
+		reference = dockerReference(b.config)
+	}
+
+	workDir, removeWorkDir, err := b.makeTempDir(os.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		return err
+	}
+	defer removeWorkDir()
+
+	// References without a tag default to latest
+	tag := referenceTag(reference)
+	if !strings.HasSuffix(reference, ":"+tag) {
+		reference += ":" + tag
+	}
+
+	manifest, err := b.writeOCILayout(output, workDir, tag)
+	if err != nil {
+		return err
+	}
+
+	dockerManifests := []dockerManifest{{
+		Config:   blobPath(manifest.Config),
+		RepoTags: []string{reference},
+		Layers:   make([]string, 0, len(manifest.Layers)),
+	}}
+	for _, layer := range manifest.Layers {
+		dockerManifests[0].Layers = append(dockerManifests[0].Layers, blobPath(layer))
+	}
+
+	data, err := json.Marshal(dockerManifests)
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(workDir, "manifest.json"), data, 0644); err != nil {
+		return fmt.Errorf("error while writing manifest.json: %w", err)
+	}
+
+	fmt.Fprintf(b.loggerErr, "Tagging image as '%s'\n", reference)
+
+	return writeDirectoryTar(workDir, archivePath)
+}
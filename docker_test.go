@@ -0,0 +1,109 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestDockerReference(t *testing.T) {
+	references := map[[2]string]string{
+		{"Debian Unstable", "sid"}:    "debian-unstable:sid",
+		{"test", "bookworm"}:          "test:bookworm",
+		{"Jetson Nano (P3448)", "12"}: "jetson-nano-p3448:12",
+		{"--", "bookworm-backports"}:  "debian:bookworm-backports",
+	}
+
+	for input, expected := range references {
+		config := &ConfigurationV1{Name: input[0], Release: input[1], Distribution: DistributionDebian}
+		if reference := dockerReference(config); reference != expected {
+			t.Errorf("expected reference '%s', got: '%s'", expected, reference)
+		}
+		if !validReference.MatchString(dockerReference(config)) {
+			t.Errorf("expected derived reference '%s' to be valid", expected)
+		}
+	}
+}
+
+func TestReferenceTag(t *testing.T) {
+	tags := map[string]string{
+		"registry.example.com/rootfs:bookworm": "bookworm",
+		"localhost:5000/team/rootfs":           "latest",
+		"rootfs":                               "latest",
+	}
+
+	for reference, expected := range tags {
+		if tag := referenceTag(reference); tag != expected {
+			t.Errorf("expected tag '%s' of '%s', got: '%s'", expected, reference, tag)
+		}
+	}
+}
+
+func TestCheckDockerOutput(t *testing.T) {
+	for _, tag := range []string{"registry.example.com/rootfs:bookworm", "localhost:5000/team/rootfs:1.0", "rootfs"} {
+		if err := checkDockerOutput(&OutputV1{Type: OutputTypeDocker, Tag: tag}); err != nil {
+			t.Errorf("expected no error for tag '%s', got: %s", tag, err)
+		}
+	}
+
+	for _, tag := range []string{"Rootfs:bookworm", "rootfs:", "rootfs:-bad"} {
+		if err := checkDockerOutput(&OutputV1{Type: OutputTypeDocker, Tag: tag}); err == nil {
+			t.Errorf("expected error for tag '%s'", tag)
+		}
+	}
+}
+
+func TestBuildDockerArchive(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	archivePath := builder.artifactPath("docker.tar")
+	if err := builder.buildDockerArchive(&OutputV1{Type: OutputTypeDocker}, archivePath); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	fd, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(fd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = data
+	}
+
+	manifests := []dockerManifest{}
+	if err = json.Unmarshal(files["manifest.json"], &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("expected manifest.json with one entry, got: %s", files["manifest.json"])
+	}
+
+	if len(manifests[0].RepoTags) != 1 || manifests[0].RepoTags[0] != "test:bookworm" {
+		t.Errorf("unexpected repository tags: %v", manifests[0].RepoTags)
+	}
+
+	for _, name := range append(manifests[0].Layers, manifests[0].Config) {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected '%s' to be part of the archive", name)
+		}
+	}
+}
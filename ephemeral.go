@@ -0,0 +1,212 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Suffix of originals moved aside for an injected file
+	EphemeralBackupSuffix = ".rootfsbuilder-orig"
+	AptProxyConfPath      = "/etc/apt/apt.conf.d/00rootfsbuilder-proxy"
+)
+
+func checkBuildFile(file *BuildFileV1) error {
+	if file.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if !path.IsAbs(file.Target) || path.Clean(file.Target) == "/" {
+		return fmt.Errorf("target must be an absolute file path: '%s'", file.Target)
+	}
+	for _, component := range strings.Split(file.Target, "/") {
+		if component == ".." {
+			return fmt.Errorf("target must not contain '..': '%s'", file.Target)
+		}
+	}
+	if file.Mode != "" {
+		mode, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("invalid octal permissions: '%s'", file.Mode)
+		}
+	}
+
+	return nil
+}
+
+// Creates the missing parent directories of a path in the rootfs. Symlinks
+// are rejected, as they would be resolved on the host. Returns the created
+// directories.
+func (b *Builder) makeParents(target string) ([]string, error) {
+	created := []string{}
+	current := b.rootfs
+	components := strings.Split(strings.Trim(path.Clean(target), "/"), "/")
+
+	for i, component := range components[:len(components)-1] {
+		current = filepath.Join(current, component)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err = os.Mkdir(current, 0755); err != nil {
+				return created, err
+			}
+			created = append(created, current)
+			continue
+		} else if err != nil {
+			return created, err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return created, fmt.Errorf("'%s' is a symlink in the rootfs", "/"+path.Join(components[:i+1]...))
+		}
+		if !info.IsDir() {
+			return created, fmt.Errorf("'%s' is not a directory", "/"+path.Join(components[:i+1]...))
+		}
+	}
+
+	return created, nil
+}
+
+// Places a file in the rootfs that only exists while the rootfs is built.
+// The original (a file, a symlink, or nothing) is moved aside and restored
+// exactly, and created parent directories are removed again. The returned
+// function restores the original. It is registered on the teardown stack,
+// and collected for restoreEphemeralFiles.
+func (b *Builder) injectFile(target string, write func(dest string) error) (func() error, error) {
+	created, err := b.makeParents(target)
+	removeCreated := func() {
+		for i := len(created) - 1; i >= 0; i-- {
+			// Only if still empty
+			_ = os.Remove(created[i])
+		}
+	}
+	if err != nil {
+		removeCreated()
+		return nil, fmt.Errorf("error while creating parent directories of '%s': %w", target, err)
+	}
+
+	dest := filepath.Join(b.rootfs, target)
+	backup := dest + EphemeralBackupSuffix
+
+	if _, err = os.Lstat(backup); err == nil {
+		removeCreated()
+		return nil, fmt.Errorf("backup '%s' already exists", target+EphemeralBackupSuffix)
+	}
+
+	existed := false
+	if _, err = os.Lstat(dest); err == nil {
+		existed = true
+		if err = os.Rename(dest, backup); err != nil {
+			removeCreated()
+			return nil, fmt.Errorf("error while moving '%s' aside: %w", target, err)
+		}
+	}
+
+	restore := func() error {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("error while removing '%s': %w", target, err)
+		}
+		if existed {
+			if err := os.Rename(backup, dest); err != nil {
+				return fmt.Errorf("error while restoring '%s': %w", target, err)
+			}
+		}
+		removeCreated()
+		return nil
+	}
+
+	if err = write(dest); err != nil {
+		_ = restore()
+		return nil, fmt.Errorf("error while writing '%s': %w", target, err)
+	}
+
+	release := b.teardown.Push("restore "+target, restore)
+	b.ephemeralFiles = append(b.ephemeralFiles, release)
+
+	return release, nil
+}
+
+// Injects a file with the given content
+func (b *Builder) injectContent(target string, data []byte, perm os.FileMode) (func() error, error) {
+	return b.injectFile(target, func(dest string) error {
+		if err := os.WriteFile(dest, data, perm); err != nil {
+			return err
+		}
+		// Not subject to the umask
+		return os.Chmod(dest, perm)
+	})
+}
+
+// Injects a copy of a host file
+func (b *Builder) injectCopy(target string, source string, perm os.FileMode) (func() error, error) {
+	return b.injectFile(target, func(dest string) error {
+		if err := copyFile(source, dest, perm); err != nil {
+			return err
+		}
+		return os.Chmod(dest, perm)
+	})
+}
+
+// Restores the originals of all injected files, in reverse order
+func (b *Builder) restoreEphemeralFiles() error {
+	var firstErr error
+	for i := len(b.ephemeralFiles) - 1; i >= 0; i-- {
+		if err := b.ephemeralFiles[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.ephemeralFiles = nil
+
+	return firstErr
+}
+
+// Injects the files only needed while the post install command runs: the
+// host's resolv.conf, the apt proxy configuration, and the configured build
+// files
+func (b *Builder) injectBuildFiles() error {
+	if b.config.UseHostsResolvConf {
+		fmt.Fprintf(b.loggerErr, "Using the host's resolv.conf during the build\n")
+		if _, err := b.injectCopy("/etc/resolv.conf", "/etc/resolv.conf", 0644); err != nil {
+			return err
+		}
+	}
+
+	if b.config.AptProxy != "" {
+		conf := fmt.Sprintf("Acquire::http::Proxy \"%s\";\n", b.config.AptProxy)
+		if _, err := b.injectContent(AptProxyConfPath, []byte(conf), 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range b.config.BuildFiles {
+		source := file.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(filepath.Dir(b.config.absoluteConfigPath), source)
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("error while checking build file: %w", err)
+		}
+		perm := info.Mode().Perm()
+		if file.Mode != "" {
+			mode, _ := strconv.ParseUint(file.Mode, 8, 32)
+			perm = os.FileMode(mode)
+		}
+
+		if _, err = b.injectCopy(file.Target, source, perm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
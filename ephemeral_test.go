@@ -0,0 +1,125 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBuildFile(t *testing.T) {
+	if err := checkBuildFile(&BuildFileV1{Source: "auth.conf", Target: "/etc/apt/auth.conf.d/build.conf", Mode: "0600"}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := map[string]BuildFileV1{
+		"missing source":  {Target: "/etc/apt/auth.conf"},
+		"relative target": {Source: "auth.conf", Target: "etc/apt/auth.conf"},
+		"root target":     {Source: "auth.conf", Target: "/"},
+		"escaping target": {Source: "auth.conf", Target: "/etc/../../auth.conf"},
+		"invalid mode":    {Source: "auth.conf", Target: "/etc/apt/auth.conf", Mode: "rw"},
+		"setuid mode":     {Source: "auth.conf", Target: "/etc/apt/auth.conf", Mode: "4755"},
+	}
+	for name, file := range invalid {
+		if err := checkBuildFile(&file); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestInjectFileRestoresOriginals(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	rootfs := builder.rootfs
+
+	// systemd-resolved setup
+	if err := os.Symlink("../run/systemd/resolve/stub-resolv.conf", rootfs+"/etc/resolv.conf"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := builder.injectContent("/etc/resolv.conf", []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := builder.injectContent("/etc/hostname", []byte("build\n"), 0644); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := builder.injectContent("/etc/apt/auth.conf.d/build.conf", []byte("machine example.com\n"), 0600); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if data, _ := os.ReadFile(rootfs + "/etc/resolv.conf"); string(data) != "nameserver 10.0.0.1\n" {
+		t.Errorf("expected injected resolv.conf, got: %q", data)
+	}
+	if info, err := os.Stat(rootfs + "/etc/apt/auth.conf.d/build.conf"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected injected credentials with mode 0600, got: %v", info)
+	}
+
+	if err := builder.restoreEphemeralFiles(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if link, err := os.Readlink(rootfs + "/etc/resolv.conf"); err != nil || link != "../run/systemd/resolve/stub-resolv.conf" {
+		t.Errorf("expected resolv.conf symlink to be restored, got: %q, %v", link, err)
+	}
+	if data, _ := os.ReadFile(rootfs + "/etc/hostname"); string(data) != "rootfsbuilder\n" {
+		t.Errorf("expected hostname to be restored, got: %q", data)
+	}
+	if _, err := os.Stat(rootfs + "/etc/apt"); !os.IsNotExist(err) {
+		t.Error("expected created directories to be removed")
+	}
+	if matches, _ := filepath.Glob(rootfs + "/etc/*" + EphemeralBackupSuffix); len(matches) != 0 {
+		t.Errorf("expected no backups to be left, got: %v", matches)
+	}
+
+	// Nothing is left for the teardown
+	if err := builder.teardown.Run(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if link, _ := os.Readlink(rootfs + "/etc/resolv.conf"); link == "" {
+		t.Error("expected teardown not to restore twice")
+	}
+}
+
+func TestInjectFileRejectsSymlinkedParents(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	if err := os.Symlink("/", builder.rootfs+"/host"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := builder.injectContent("/host/etc/passwd", []byte("x"), 0644); err == nil {
+		t.Error("expected error for symlink in target")
+	}
+}
+
+func TestInjectBuildFiles(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	configDir := t.TempDir()
+	if err := os.WriteFile(configDir+"/auth.conf", []byte("machine example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builder.config.absoluteConfigPath = configDir + "/config.json"
+	builder.config.AptProxy = "http://proxy:3142"
+	builder.config.BuildFiles = []BuildFileV1{{Source: "auth.conf", Target: "/etc/apt/auth.conf.d/build.conf", Mode: "0600"}}
+
+	if err := builder.injectBuildFiles(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if data, _ := os.ReadFile(builder.rootfs + AptProxyConfPath); string(data) != "Acquire::http::Proxy \"http://proxy:3142\";\n" {
+		t.Errorf("unexpected proxy configuration: %q", data)
+	}
+	if info, err := os.Stat(builder.rootfs + "/etc/apt/auth.conf.d/build.conf"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected build file with mode 0600, got: %v, %v", info, err)
+	}
+
+	if err := builder.restoreEphemeralFiles(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := os.Stat(builder.rootfs + "/etc/apt"); !os.IsNotExist(err) {
+		t.Error("expected build files to be removed")
+	}
+}
@@ -0,0 +1,173 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func checkFatOutput(output *OutputV1) error {
+	size, err := parseSize(output.Size)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("size is required")
+	}
+
+	if output.FatSize != 0 && output.FatSize != 12 && output.FatSize != 16 && output.FatSize != 32 {
+		return fmt.Errorf("unsupported FAT size: %d", output.FatSize)
+	}
+
+	if output.Source != "" && !path.IsAbs(output.Source) {
+		return fmt.Errorf("source '%s' is not absolute", output.Source)
+	}
+
+	for _, file := range output.Files {
+		if file == "" || path.IsAbs(file) || strings.HasPrefix(path.Clean(file), "..") {
+			return fmt.Errorf("file '%s' must be relative to the source", file)
+		}
+	}
+
+	return checkFatLabel(output.Label)
+}
+
+// FAT volume labels are limited to 11 characters
+func checkFatLabel(label string) error {
+	if len(label) > 11 {
+		return fmt.Errorf("FAT volume label '%s' exceeds 11 characters", label)
+	}
+
+	return nil
+}
+
+// Returns the FAT size for the partition filesystem (0 for automatic)
+func fatSizeOf(filesystem string) int {
+	switch filesystem {
+	case FilesystemFat16:
+		return 16
+	case FilesystemFat32:
+		return 32
+	}
+
+	return 0
+}
+
+func (b *Builder) buildFatImage(output *OutputV1, imagePath string) error {
+	size, err := parseSize(output.Size)
+	if err != nil {
+		return err
+	}
+
+	source := output.Source
+	if source == "" {
+		source = "/"
+	}
+
+	return b.makeFatFilesystem(path.Join(b.rootfs, source), output.Files, imagePath, size, output.FatSize, output.Label)
+}
+
+// Creates a FAT filesystem image and populates it with mtools, so no
+// mounting is required. If files is empty, the whole source directory is
+// copied.
+func (b *Builder) makeFatFilesystem(sourceDir string, files []string, imagePath string, sizeBytes uint64, fatSize int, label string) error {
+	fd, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("error while creating image: %w", err)
+	}
+	err = fd.Truncate(int64(sizeBytes))
+	fd.Close()
+	if err != nil {
+		return fmt.Errorf("error while resizing image: %w", err)
+	}
+
+	args := []string{}
+	if fatSize != 0 {
+		args = append(args, "-F", strconv.Itoa(fatSize))
+	}
+	if label != "" {
+		args = append(args, "-n", strings.ToUpper(label))
+	}
+	args = append(args, imagePath)
+
+	if err = b.runMtool("mkfs.fat", args...); err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		entries, err := os.ReadDir(sourceDir)
+		if err != nil {
+			return fmt.Errorf("error while reading source directory: %w", err)
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		args = []string{"-i", imagePath, "-s", "-Q", "-m"}
+		for _, entry := range entries {
+			args = append(args, path.Join(sourceDir, entry.Name()))
+		}
+		args = append(args, "::/")
+
+		return b.runMtool("mcopy", args...)
+	}
+
+	// Create parent directories of the listed files first
+	dirs := map[string]bool{}
+	for _, file := range files {
+		for dir := path.Dir(path.Clean(file)); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+
+	if len(dirs) > 0 {
+		sorted := make([]string, 0, len(dirs))
+		for dir := range dirs {
+			sorted = append(sorted, dir)
+		}
+		// Parents sort before their children
+		sort.Strings(sorted)
+
+		args = []string{"-i", imagePath}
+		for _, dir := range sorted {
+			args = append(args, "::/"+dir)
+		}
+
+		if err = b.runMtool("mmd", args...); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		file = path.Clean(file)
+		if err = b.runMtool("mcopy", "-i", imagePath, "-s", "-Q", "-m", path.Join(sourceDir, file), "::/"+file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) runMtool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	// Image files have no meaningful disk geometry
+	cmd.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while running %s: %w", name, err)
+	}
+
+	return nil
+}
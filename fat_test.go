@@ -0,0 +1,62 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFatOutput(t *testing.T) {
+	output := &OutputV1{Type: OutputTypeFat, Size: "64M", Source: "/boot", FatSize: 32, Label: "BOOT"}
+	if err := checkFatOutput(output); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	output.Files = []string{"Image", "extlinux/extlinux.conf"}
+	if err := checkFatOutput(output); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := []*OutputV1{
+		{Type: OutputTypeFat},
+		{Type: OutputTypeFat, Size: "64M", FatSize: 24},
+		{Type: OutputTypeFat, Size: "64M", Source: "boot"},
+		{Type: OutputTypeFat, Size: "64M", Files: []string{"/boot/Image"}},
+		{Type: OutputTypeFat, Size: "64M", Files: []string{"../etc/shadow"}},
+		{Type: OutputTypeFat, Size: "64M", Label: "MUCH-TOO-LONG"},
+	}
+	for i, output := range invalid {
+		if err := checkFatOutput(output); err == nil {
+			t.Errorf("expected error for invalid FAT output %d", i+1)
+		}
+	}
+}
+
+func TestFatPartitionFstab(t *testing.T) {
+	output := &OutputV1{
+		Type:           OutputTypeDisk,
+		PartitionTable: PartitionTableMBR,
+		Partitions: []PartitionV1{
+			{Name: "BOOT", Size: "64M", Type: "fat32", Filesystem: FilesystemFat32, MountPoint: "/boot/firmware"},
+			{Name: "rootfs", Size: "1G", Type: "linux", Filesystem: FilesystemExt4, MountPoint: "/"},
+		},
+	}
+	if err := checkDiskOutput(output); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	table, err := newPartitionTable(output)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	fstab := generateFstab(output, table)
+	if !strings.Contains(fstab, "PARTUUID="+table.PartUUID(0)+" /boot/firmware vfat defaults 0 2\n") {
+		t.Errorf("expected vfat fstab entry, got:\n%s", fstab)
+	}
+}
@@ -0,0 +1,239 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Keys trusted by apt in the finished rootfs
+	AptTrustedKeysDir = "/etc/apt/trusted.gpg.d"
+	// Name of an inline key in the rootfs and the bootstrapper's keyring
+	InlineKeyringName = "rootfsbuilder-mirror"
+	armorBegin        = "-----BEGIN "
+	armorEnd          = "-----END "
+)
+
+// Reports whether a keyring is an inline key instead of a file path
+func isInlineKey(keyring string) bool {
+	return strings.HasPrefix(strings.TrimSpace(keyring), armorBegin)
+}
+
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte(armorBegin))
+}
+
+// CRC-24 of the OpenPGP armor checksum (RFC 4880, section 6.1)
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+
+	return crc & 0xffffff
+}
+
+// Decodes an ASCII-armored OpenPGP key into the binary format expected by
+// gpgv, like gpg --dearmor
+func dearmor(data []byte) ([]byte, error) {
+	var body strings.Builder
+	checksum := ""
+	// 0: before the block, 1: armor headers, 2: body, 3: after the block
+	state := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case state == 0 && strings.HasPrefix(line, armorBegin):
+			state = 1
+		case state == 1 && line == "":
+			state = 2
+		case state == 1 && !strings.Contains(line, ":"):
+			// Armor without headers or separating blank line
+			state = 2
+			body.WriteString(line)
+		case state == 2 && strings.HasPrefix(line, armorEnd):
+			state = 3
+		case state == 2 && strings.HasPrefix(line, "="):
+			checksum = line[1:]
+		case state == 2:
+			body.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if state != 3 {
+		return nil, fmt.Errorf("incomplete ASCII-armored key")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASCII-armored key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty ASCII-armored key")
+	}
+
+	if checksum != "" {
+		sum, err := base64.StdEncoding.DecodeString(checksum)
+		if err != nil || len(sum) != 3 {
+			return nil, fmt.Errorf("invalid ASCII armor checksum")
+		}
+		if uint32(sum[0])<<16|uint32(sum[1])<<8|uint32(sum[2]) != crc24(key) {
+			return nil, fmt.Errorf("ASCII armor checksum mismatch")
+		}
+	}
+
+	return key, nil
+}
+
+// Returns the path of the configured keyring file
+func keyringPath(config *ConfigurationV1) string {
+	if filepath.IsAbs(config.Keyring) {
+		return config.Keyring
+	}
+
+	return filepath.Join(filepath.Dir(config.absoluteConfigPath), config.Keyring)
+}
+
+// Returns the name and content of the configured key, as configured
+func readKeyringFile(config *ConfigurationV1) (string, []byte, error) {
+	if isInlineKey(config.Keyring) {
+		return InlineKeyringName, []byte(config.Keyring), nil
+	}
+
+	path := keyringPath(config)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("error while reading keyring: %w", err)
+	}
+
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), data, nil
+}
+
+// Returns the name and content of the configured OpenPGP key. Armored keys
+// are decoded.
+func readKeyring(config *ConfigurationV1) (string, []byte, error) {
+	name, data, err := readKeyringFile(config)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if isArmored(data) {
+		if data, err = dearmor(data); err != nil {
+			return "", nil, fmt.Errorf("error while reading keyring: %w", err)
+		}
+	}
+
+	return name, data, nil
+}
+
+func checkKeyring(config *ConfigurationV1, bootstrapper Bootstrapper) error {
+	// The host's RPM keys (if any) belong to the host's distribution
+	if bootstrapper.Name() == BootstrapperDnf && config.Keyring == "" && !config.InsecureSkipVerify {
+		return fmt.Errorf("keyring is required for dnf, configure the key of the release (e.g. RPM-GPG-KEY-Rocky-9)")
+	}
+	if config.Keyring == "" {
+		return nil
+	}
+	if config.InsecureSkipVerify {
+		return fmt.Errorf("keyring and insecure_skip_verify are mutually exclusive")
+	}
+
+	if bootstrapper.Name() == BootstrapperApk {
+		// apk signing keys are RSA keys, which apk finds by their file name
+		if isInlineKey(config.Keyring) {
+			return fmt.Errorf("inline keys are not supported by apk, use the path of the key file")
+		}
+		if _, err := os.Stat(keyringPath(config)); err != nil {
+			return fmt.Errorf("error while reading keyring: %w", err)
+		}
+		return nil
+	}
+
+	_, _, err := readKeyring(config)
+	return err
+}
+
+// Writes the configured keyring for the bootstrapper and returns the
+// keyrings to verify with: the configured one in addition to those of the
+// distribution, or instead of them for debootstrap, which only accepts one
+// keyring. The file is removed on teardown.
+func (b *Builder) prepareKeyring(bootstrapper Bootstrapper, keyrings []string) ([]string, error) {
+	if bootstrapper.Name() == BootstrapperDebootstrap {
+		keyrings = nil
+	}
+
+	if bootstrapper.Name() == BootstrapperApk {
+		return append(keyrings, keyringPath(b.config)), nil
+	}
+
+	// gpgv expects binary keys, rpm imports keys as configured
+	read, extension := readKeyring, ".gpg"
+	if bootstrapper.Name() == BootstrapperDnf {
+		read, extension = readKeyringFile, ".key"
+	}
+
+	name, key, err := read(b.config)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, _, err := b.makeTempDir(os.TempDir(), TempDirPrefix+"keyring-")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name+extension)
+	if err = os.WriteFile(path, key, 0644); err != nil {
+		return nil, fmt.Errorf("error while writing keyring: %w", err)
+	}
+
+	return append(keyrings, path), nil
+}
+
+// Installs the configured keyring into the rootfs, so that apt in the
+// finished rootfs trusts the mirror it was built from. apk keys are
+// installed by the bootstrapper.
+func (b *Builder) installKeyring() error {
+	if b.config.Keyring == "" {
+		return nil
+	}
+	// Only present in rootfs with apt
+	if info, err := os.Lstat(filepath.Join(b.rootfs, AptTrustedKeysDir)); err != nil || !info.IsDir() {
+		return nil
+	}
+
+	name, key, err := readKeyring(b.config)
+	if err != nil {
+		return err
+	}
+
+	target := filepath.Join(AptTrustedKeysDir, name+".gpg")
+	fmt.Fprintf(b.loggerErr, "Installing keyring '%s'\n", target)
+	if err = os.WriteFile(filepath.Join(b.rootfs, target), key, 0644); err != nil {
+		return fmt.Errorf("error while installing keyring: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// "rootfsbuilder test key", armored with gpg --enarmor
+const testArmoredKey = `-----BEGIN PGP PUBLIC KEY BLOCK-----
+Comment: Use "gpg --dearmor" for unpacking
+
+cm9vdGZzYnVpbGRlciB0ZXN0IGtleQ==
+=OlF4
+-----END PGP PUBLIC KEY BLOCK-----
+`
+
+const testKey = "rootfsbuilder test key"
+
+func TestDearmor(t *testing.T) {
+	key, err := dearmor([]byte(testArmoredKey))
+	if err != nil || string(key) != testKey {
+		t.Errorf("expected '%s', got: %q, %v", testKey, key, err)
+	}
+
+	// Without armor headers
+	withoutHeaders := strings.Replace(testArmoredKey, "Comment: Use \"gpg --dearmor\" for unpacking\n\n", "", 1)
+	if key, err = dearmor([]byte(withoutHeaders)); err != nil || string(key) != testKey {
+		t.Errorf("expected '%s', got: %q, %v", testKey, key, err)
+	}
+
+	if _, err = dearmor([]byte(strings.Replace(testArmoredKey, "=OlF4", "=OlF5", 1))); err == nil {
+		t.Error("expected error for checksum mismatch")
+	}
+	if _, err = dearmor([]byte(strings.SplitN(testArmoredKey, "-----END", 2)[0])); err == nil {
+		t.Error("expected error for incomplete key")
+	}
+}
+
+func TestCheckKeyring(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mirror.asc"), []byte(testArmoredKey), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ConfigurationV1{absoluteConfigPath: filepath.Join(dir, "config.json"), Keyring: "mirror.asc"}
+	if err := checkKeyring(config, &debootstrap{}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err := checkKeyring(config, &apk{}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	config.InsecureSkipVerify = true
+	if err := checkKeyring(config, &debootstrap{}); err == nil {
+		t.Error("expected error for keyring with insecure_skip_verify")
+	}
+
+	config = &ConfigurationV1{absoluteConfigPath: filepath.Join(dir, "config.json"), Keyring: testArmoredKey}
+	if err := checkKeyring(config, &mmdebstrap{}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err := checkKeyring(config, &apk{}); err == nil {
+		t.Error("expected error for inline key with apk")
+	}
+
+	config.Keyring = "missing.gpg"
+	if err := checkKeyring(config, &debootstrap{}); err == nil {
+		t.Error("expected error for missing keyring")
+	}
+
+	// The host's RPM keys are not used
+	config = &ConfigurationV1{absoluteConfigPath: filepath.Join(dir, "config.json")}
+	if err := checkKeyring(config, &dnf{}); err == nil {
+		t.Error("expected error for dnf without keyring")
+	}
+	config.InsecureSkipVerify = true
+	if err := checkKeyring(config, &dnf{}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
+
+func TestPrepareKeyring(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	builder.config.Keyring = testArmoredKey
+	defer builder.teardown.Run()
+
+	// debootstrap accepts only one keyring
+	keyrings, err := builder.prepareKeyring(&debootstrap{}, []string{"/usr/share/keyrings/debian-archive-keyring.gpg"})
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(keyrings) != 1 || filepath.Base(keyrings[0]) != InlineKeyringName+".gpg" {
+		t.Fatalf("unexpected keyrings: %q", keyrings)
+	}
+	if data, _ := os.ReadFile(keyrings[0]); string(data) != testKey {
+		t.Errorf("expected dearmored key, got: %q", data)
+	}
+
+	if keyrings, err = builder.prepareKeyring(&mmdebstrap{}, []string{"/usr/share/keyrings/debian-archive-keyring.gpg"}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(keyrings) != 2 || keyrings[0] != "/usr/share/keyrings/debian-archive-keyring.gpg" {
+		t.Errorf("expected key in addition to the distribution's keyring, got: %q", keyrings)
+	}
+
+	if keyrings, err = builder.prepareKeyring(&dnf{}, nil); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if data, _ := os.ReadFile(keyrings[0]); filepath.Ext(keyrings[0]) != ".key" || string(data) != testArmoredKey {
+		t.Errorf("expected armored key, got: %s: %q", keyrings[0], data)
+	}
+
+	builder.config.Keyring = "/srv/apk/packager@example.com-5f8c3a1b.rsa.pub"
+	if keyrings, err = builder.prepareKeyring(&apk{}, []string{ApkKeysDir}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if strings.Join(keyrings, ",") != ApkKeysDir+",/srv/apk/packager@example.com-5f8c3a1b.rsa.pub" {
+		t.Errorf("expected key in addition to the distribution's keys, got: %q", keyrings)
+	}
+}
+
+func TestInstallKeyring(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	builder.config.Keyring = testArmoredKey
+
+	// Not a rootfs with apt
+	if err := builder.installKeyring(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := os.Stat(builder.rootfs + AptTrustedKeysDir); !os.IsNotExist(err) {
+		t.Errorf("expected '%s' not to be created, got: %v", AptTrustedKeysDir, err)
+	}
+
+	if err := os.MkdirAll(builder.rootfs+AptTrustedKeysDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.installKeyring(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if data, _ := os.ReadFile(builder.rootfs + AptTrustedKeysDir + "/" + InlineKeyringName + ".gpg"); string(data) != testKey {
+		t.Errorf("expected installed key, got: %q", data)
+	}
+}
@@ -0,0 +1,255 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	lxcTemplateTriggers = map[string]bool{"create": true, "copy": true, "start": true}
+)
+
+func checkLXCOutput(output *OutputV1) error {
+	switch output.Format {
+	case "", OutputFormatSplit:
+		if output.RootfsType != "" && output.RootfsType != RootfsTypeSquashfs && output.RootfsType != RootfsTypeTarGz {
+			return fmt.Errorf("unsupported rootfs type '%s'", output.RootfsType)
+		}
+	case OutputFormatUnified:
+		if output.RootfsType != "" {
+			return fmt.Errorf("rootfs type is only supported for split images")
+		}
+	default:
+		return fmt.Errorf("unsupported format '%s'", output.Format)
+	}
+
+	names := map[string]bool{}
+	for _, template := range output.Templates {
+		if !path.IsAbs(template.Path) {
+			return fmt.Errorf("template path '%s' is not absolute", template.Path)
+		}
+		if template.Template == "" {
+			return fmt.Errorf("template file for '%s' is required", template.Path)
+		}
+
+		name := path.Base(template.Template)
+		if names[name] {
+			return fmt.Errorf("duplicate template file name '%s'", name)
+		}
+		names[name] = true
+
+		if len(template.When) == 0 {
+			return fmt.Errorf("template '%s' requires at least one trigger", template.Path)
+		}
+		for _, when := range template.When {
+			if !lxcTemplateTriggers[when] {
+				return fmt.Errorf("unsupported template trigger '%s'", when)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Quotes a string for YAML. JSON strings are valid YAML double-quoted
+// scalars.
+func yamlQuote(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// Generates the metadata.yaml of an LXC/Incus image
+func (b *Builder) lxcMetadata(output *OutputV1) (string, error) {
+	arch, err := DebToLXCArch(b.config.Architecture)
+	if err != nil {
+		return "", err
+	}
+
+	description := output.Description
+	if description == "" {
+		description = fmt.Sprintf("%s (%s %s %s)", b.config.Name, b.config.Distribution, b.config.Release, b.config.Architecture)
+	}
+
+	var buf strings.Builder
+
+	fmt.Fprintf(&buf, "architecture: %s\n", yamlQuote(arch))
+	fmt.Fprintf(&buf, "creation_date: %d\n", b.buildTime.Unix())
+	buf.WriteString("properties:\n")
+	fmt.Fprintf(&buf, "  architecture: %s\n", yamlQuote(b.config.Architecture))
+	fmt.Fprintf(&buf, "  description: %s\n", yamlQuote(description))
+	fmt.Fprintf(&buf, "  name: %s\n", yamlQuote(b.config.Name))
+	fmt.Fprintf(&buf, "  os: %s\n", yamlQuote(b.config.Distribution))
+	fmt.Fprintf(&buf, "  release: %s\n", yamlQuote(b.config.Release))
+
+	if len(output.Templates) == 0 {
+		return buf.String(), nil
+	}
+
+	buf.WriteString("templates:\n")
+	for _, template := range output.Templates {
+		fmt.Fprintf(&buf, "  %s:\n", yamlQuote(template.Path))
+		fmt.Fprintf(&buf, "    template: %s\n", yamlQuote(path.Base(template.Template)))
+		fmt.Fprintf(&buf, "    create_only: %t\n", template.CreateOnly)
+		buf.WriteString("    when:\n")
+		for _, when := range template.When {
+			fmt.Fprintf(&buf, "      - %s\n", yamlQuote(when))
+		}
+
+		if len(template.Properties) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(template.Properties))
+		for key := range template.Properties {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteString("    properties:\n")
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "      %s: %s\n", yamlQuote(key), yamlQuote(template.Properties[key]))
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// Writes metadata.yaml and the templates directory into dir
+func (b *Builder) writeLXCMetadata(output *OutputV1, dir string) error {
+	metadata, err := b.lxcMetadata(output)
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "metadata.yaml"), []byte(metadata), 0644); err != nil {
+		return fmt.Errorf("error while writing metadata.yaml: %w", err)
+	}
+
+	if len(output.Templates) == 0 {
+		return nil
+	}
+
+	templateDir := filepath.Join(dir, "templates")
+	if err = os.Mkdir(templateDir, 0755); err != nil {
+		return fmt.Errorf("error while creating templates directory: %w", err)
+	}
+
+	for _, template := range output.Templates {
+		source := path.Dir(b.config.absoluteConfigPath) + "/" + template.Template
+		if err = copyFile(source, filepath.Join(templateDir, path.Base(template.Template)), 0644); err != nil {
+			return fmt.Errorf("error while copying template '%s': %w", template.Template, err)
+		}
+	}
+
+	return nil
+}
+
+// Builds an LXC/Incus image that can be imported with 'incus image import'.
+// Split images consist of a metadata tarball and a rootfs squashfs or
+// tarball. Unified images are a single tarball with the rootfs in rootfs/.
+// Returns the paths of the created files.
+func (b *Builder) buildLXCImage(output *OutputV1) ([]string, error) {
+	workDir, removeWorkDir, err := b.makeTempDir(os.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		return nil, err
+	}
+	defer removeWorkDir()
+
+	if err = b.writeLXCMetadata(output, workDir); err != nil {
+		return nil, err
+	}
+
+	if output.Format == OutputFormatUnified {
+		imagePath := b.artifactPath("lxc.tar.gz")
+		if err = b.writeUnifiedLXCImage(workDir, imagePath); err != nil {
+			return nil, err
+		}
+
+		return []string{imagePath}, nil
+	}
+
+	metadataPath := b.artifactPath("lxc.metadata.tar")
+	if err = writeDirectoryTar(workDir, metadataPath); err != nil {
+		return nil, err
+	}
+
+	if output.RootfsType == RootfsTypeTarGz {
+		rootfsPath := b.artifactPath("lxc.rootfs.tar.gz")
+		if err = b.writeTarball(rootfsPath, CompressionGzip, nil); err != nil {
+			return nil, err
+		}
+
+		return []string{metadataPath, rootfsPath}, nil
+	}
+
+	rootfsPath := b.artifactPath("lxc.squashfs")
+	if err = b.makeSquashfs(b.rootfs, rootfsPath); err != nil {
+		return nil, err
+	}
+
+	return []string{metadataPath, rootfsPath}, nil
+}
+
+// Writes a gzip compressed tarball with the metadata in metadataDir, and the
+// rootfs in rootfs/
+func (b *Builder) writeUnifiedLXCImage(metadataDir string, imagePath string) error {
+	fd, err := os.Create(imagePath)
+	if err != nil {
+		return fmt.Errorf("error while creating image: %w", err)
+	}
+	defer fd.Close()
+
+	gz := gzip.NewWriter(fd)
+	tw := newTreeTarWriter(gz)
+
+	if err = writeDirectoryEntries(tw.Writer, metadataDir); err != nil {
+		return fmt.Errorf("error while writing metadata: %w", err)
+	}
+
+	err = writeTreeTar(tw, b.rootfs, tarOptions{Prefix: "rootfs", Progress: b.loggerErr, Devices: b.archiveDevices()})
+	if err != nil {
+		return fmt.Errorf("error while writing rootfs: %w", err)
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("error while writing image: %w", err)
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("error while compressing image: %w", err)
+	}
+
+	return fd.Close()
+}
+
+func copyFile(source string, dest string, perm os.FileMode) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,120 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testLXCOutput() *OutputV1 {
+	return &OutputV1{
+		Type:   OutputTypeLXC,
+		Format: OutputFormatUnified,
+		Templates: []LXCTemplateV1{
+			{Path: "/etc/hostname", Template: "templates/hostname.tpl", When: []string{"create", "copy"}, Properties: map[string]string{"default": "device"}},
+		},
+	}
+}
+
+func TestCheckLXCOutput(t *testing.T) {
+	if err := checkLXCOutput(testLXCOutput()); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	output := testLXCOutput()
+	output.RootfsType = RootfsTypeSquashfs
+	if err := checkLXCOutput(output); err == nil {
+		t.Error("expected error for rootfs type in unified image")
+	}
+
+	output = testLXCOutput()
+	output.Templates[0].When = []string{"boot"}
+	if err := checkLXCOutput(output); err == nil {
+		t.Error("expected error for unsupported template trigger")
+	}
+
+	output = testLXCOutput()
+	output.Templates[0].Path = "etc/hostname"
+	if err := checkLXCOutput(output); err == nil {
+		t.Error("expected error for relative template path")
+	}
+}
+
+func TestLXCMetadata(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	metadata, err := builder.lxcMetadata(testLXCOutput())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	expected := []string{
+		"architecture: \"aarch64\"\n",
+		"  os: \"debian\"\n",
+		"  release: \"bookworm\"\n",
+		"  \"/etc/hostname\":\n    template: \"hostname.tpl\"\n    create_only: false\n    when:\n      - \"create\"\n      - \"copy\"\n",
+		"    properties:\n      \"default\": \"device\"\n",
+	}
+	for _, s := range expected {
+		if !strings.Contains(metadata, s) {
+			t.Errorf("expected metadata to contain %q, got:\n%s", s, metadata)
+		}
+	}
+}
+
+func TestBuildUnifiedLXCImage(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	if err := os.Symlink("../proc/self/mounts", builder.rootfs+"/etc/mtab"); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := builder.buildLXCImage(testLXCOutput())
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("expected a single tarball, got: %v", paths)
+	}
+
+	fd, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]*tar.Header{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries[strings.TrimSuffix(hdr.Name, "/")] = hdr
+	}
+
+	for _, name := range []string{"metadata.yaml", "templates/hostname.tpl", "rootfs", "rootfs/etc/hostname"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("expected '%s' to be part of the image", name)
+		}
+	}
+
+	if mtab, ok := entries["rootfs/etc/mtab"]; !ok || mtab.Linkname != "../proc/self/mounts" {
+		t.Error("expected symlink target to be left untouched")
+	}
+}
@@ -23,14 +23,63 @@ const (
 
 // Configuration Enums
 const (
-	ConfigVersionV1    = 1
-	DistributionDebian = "debian"
-	DistributionUbuntu = "ubuntu"
-	TarballTypeTar     = "tar"
-	TarballTypeTarGz   = "tar.gz"
-	PayloadTypeTar     = "tar"
-	PayloadTypeTarGz   = "tar.gz"
-	VariantMinbase     = "minbase"
+	ConfigVersionV1      = 1
+	DistributionDebian   = "debian"
+	DistributionUbuntu   = "ubuntu"
+	DistributionDevuan   = "devuan"
+	DistributionKali     = "kali"
+	DistributionRaspbian = "raspbian"
+	DistributionAlpine   = "alpine"
+	DistributionFedora   = "fedora"
+	DistributionRocky    = "rocky"
+	TarballTypeTar       = "tar"
+	TarballTypeTarGz     = "tar.gz"
+	PayloadTypeTar       = "tar"
+	PayloadTypeTarGz     = "tar.gz"
+	VariantMinbase       = "minbase"
+	OutputTypeTar        = "tar"
+	OutputTypeExt4       = "ext4"
+	OutputTypeSquashfs   = "squashfs"
+	OutputTypeDirectory  = "directory"
+	OutputTypeDisk       = "disk"
+	OutputTypeFat        = "fat"
+	OutputTypeOCI        = "oci"
+	OutputTypeDocker     = "docker-archive"
+	OutputTypeBundle     = "oci-bundle"
+	OutputTypeLXC        = "lxc"
+	OutputTypeCpio       = "cpio"
+	DirectoryModeCopy    = "copy"
+	DirectoryModeMove    = "move"
+	OutputFormatSplit    = "split"
+	OutputFormatUnified  = "unified"
+	RootfsTypeSquashfs   = "squashfs"
+	RootfsTypeTarGz      = "tar.gz"
+	OutputFormatDir      = "directory"
+	OutputFormatTar      = "tar"
+	PartitionTableGPT    = "gpt"
+	PartitionTableMBR    = "mbr"
+	FilesystemExt2       = "ext2"
+	FilesystemExt3       = "ext3"
+	FilesystemExt4       = "ext4"
+	FilesystemVfat       = "vfat"
+	FilesystemFat16      = "fat16"
+	FilesystemFat32      = "fat32"
+	FilesystemSwap       = "swap"
+	FilesystemNone       = "none"
+	ImageFormatQcow2     = "qcow2"
+	ImageFormatVmdk      = "vmdk"
+	ImageFormatVhdx      = "vhdx"
+	MountTypeProc        = "proc"
+	MountTypeSysfs       = "sysfs"
+	MountTypeDevpts      = "devpts"
+	MountTypeTmpfs       = "tmpfs"
+	MountTypeBind        = "bind"
+	MountTypeNone        = "none"
+	// Bootstrappers
+	BootstrapperDebootstrap = "debootstrap"
+	BootstrapperMmdebstrap  = "mmdebstrap"
+	BootstrapperApk         = "apk"
+	BootstrapperDnf         = "dnf"
 )
 
 type ConfigurationV1 struct {
@@ -40,27 +89,206 @@ type ConfigurationV1 struct {
 	Distribution  string `json:"distribution"`
 	Release       string `json:"release"`
 	Architecture  string `json:"architecture"`
-	Mirror        string `json:"mirror"`
-	TarballType   string `json:"tarball_type"`
+	// Defaults to the mirror of the distribution
+	Mirror string `json:"mirror,omitempty"`
+	// Legacy tarball of the rootfs. Optional if outputs are configured.
+	TarballType string `json:"tarball_type,omitempty"`
 
 	// Additional options for building the rootfs
 
-	// minbase etc. (specified in debootstrap with --variant)
+	// debootstrap, mmdebstrap, apk, or dnf. Default: apk for Alpine Linux,
+	// dnf for Fedora and Rocky Linux, otherwise debootstrap, or mmdebstrap
+	// for rootless builds
+	Bootstrapper string `json:"bootstrapper,omitempty"`
+	// Mirrors used in addition to mirror (not supported by debootstrap)
+	AdditionalMirrors []string `json:"additional_mirrors,omitempty"`
+	// Key the mirror is verified with: a file path, relative to the
+	// configuration file, or an inline ASCII-armored key. Installed into
+	// the rootfs for apt.
+	Keyring string `json:"keyring,omitempty"`
+	// Packages are installed without verifying their signatures
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// Checks the release on the mirror before the build, and resolves
+	// aliases like stable to the codename
+	Preflight bool `json:"preflight,omitempty"`
+	// minbase etc. (specified in debootstrap with --variant), or the
+	// package group installed by dnf
 	Variant            string   `json:"variant,omitempty"`
 	AdditionalPackages []string `json:"additional_packages,omitempty"`
 	ExcludedPackages   []string `json:"excluded_packages,omitempty"`
-	// Additional components to install: e.g. "main", "universe"
+	// Additional components to install: e.g. "main", "universe". Defaults
+	// to the components of the distribution.
 	Components []string `json:"components,omitempty"`
 	// Extracted into the root directory of the rootfs
-	Payload            string `json:"payload,omitempty"`
-	PayloadType        string `json:"payload_type,omitempty"`
+	Payload     string `json:"payload,omitempty"`
+	PayloadType string `json:"payload_type,omitempty"`
+	// The host's resolv.conf is used while the post install command runs
 	UseHostsResolvConf bool   `json:"use_hosts_resolv_conf,omitempty"`
 	PostInstallCommand string `json:"post_install_command,omitempty"`
+	// Proxy used by apt while the post install command runs
+	AptProxy string `json:"apt_proxy,omitempty"`
+	// Files placed in the rootfs while the post install command runs
+	BuildFiles []BuildFileV1 `json:"build_files,omitempty"`
+	// Filesystems mounted for the post install command, in addition to (or
+	// replacing) the defaults: proc, sysfs, /dev, /dev/pts, and /run
+	Mounts []MountV1 `json:"mounts,omitempty"`
+	// The apt sources shipped in the rootfs, replacing those of the build
+	FinalSources *FinalSourcesV1 `json:"final_sources,omitempty"`
+	// Artifacts built from the finished rootfs
+	Outputs []OutputV1 `json:"outputs,omitempty"`
 
 	// Not part of the configuration file
 	absoluteConfigPath string
 }
 
+type OutputV1 struct {
+	// tar, ext4, squashfs, directory, disk, fat, oci, docker-archive, oci-bundle, lxc, cpio
+	Type string `json:"type"`
+	// Part of the artifact names. Required to distinguish outputs of the same type.
+	Name string `json:"name,omitempty"`
+	// Paths removed from the rootfs for this output (e.g. "/usr/share/doc/*")
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Directories
+	// Absolute path the rootfs is placed at
+	Target string `json:"target,omitempty"`
+	// copy or move. Default: copy
+	Mode string `json:"mode,omitempty"`
+	// Atomically replace an existing target
+	Replace bool `json:"replace,omitempty"`
+
+	// Disk image layout
+	PartitionTable string        `json:"partition_table,omitempty"`
+	Partitions     []PartitionV1 `json:"partitions,omitempty"`
+	// Formats the raw disk image is additionally converted to
+	Convert []ConversionV1 `json:"convert,omitempty"`
+
+	// Filesystem images
+	// Size in bytes, or with a binary suffix (e.g. "512M", "4G")
+	Size  string `json:"size,omitempty"`
+	Label string `json:"label,omitempty"`
+	// The rootfs subtree the image is built from (e.g. "/boot"). Default: "/"
+	Source string `json:"source,omitempty"`
+	// Restricts the image to these files, relative to the source
+	Files []string `json:"files,omitempty"`
+	// 12, 16, or 32. Chosen by mkfs.fat if omitted.
+	FatSize int `json:"fat_size,omitempty"`
+
+	// Container images
+	// directory or tar (oci), split or unified (lxc)
+	Format string        `json:"format,omitempty"`
+	Image  ImageConfigV1 `json:"image,omitempty"`
+	// Image reference (e.g. "registry.example.com/rootfs:bookworm"). Defaults
+	// to the configuration name and release (docker), or the release (oci).
+	Tag string `json:"tag,omitempty"`
+	// OCI runtime bundles
+	Runtime RuntimeConfigV1 `json:"runtime,omitempty"`
+
+	// LXC/Incus images
+	Description string `json:"description,omitempty"`
+	// squashfs or tar.gz (split images only). Default: squashfs
+	RootfsType string          `json:"rootfs_type,omitempty"`
+	Templates  []LXCTemplateV1 `json:"templates,omitempty"`
+
+	// Archives
+	// none, gzip, xz, zstd, or lz4 (tar and cpio). Default: none
+	Compression string `json:"compression,omitempty"`
+	// Added as /init (cpio only), relative to the configuration file
+	Init string `json:"init,omitempty"`
+}
+
+type BuildFileV1 struct {
+	// Host file, relative to the configuration file
+	Source string `json:"source"`
+	// Absolute path in the rootfs
+	Target string `json:"target"`
+	// Octal permissions (e.g. "0600"). Default: those of the source
+	Mode string `json:"mode,omitempty"`
+}
+
+type FinalSourcesV1 struct {
+	// Default: the mirror of the distribution
+	Mirror string `json:"mirror,omitempty"`
+	// Mirror of the security suite. Default: that of the distribution
+	SecurityMirror string `json:"security_mirror,omitempty"`
+	// Default: the components of the build
+	Components []string `json:"components,omitempty"`
+	// The updates and security suites of the distribution are shipped,
+	// unless disabled
+	NoUpdates  bool `json:"no_updates,omitempty"`
+	NoSecurity bool `json:"no_security,omitempty"`
+	// list (/etc/apt/sources.list) or deb822 (.sources). Default: the
+	// format of the bootstrapped rootfs
+	Format string `json:"format,omitempty"`
+}
+
+type MountV1 struct {
+	// proc, sysfs, devpts, tmpfs, bind, or none (removes a default mount)
+	Type string `json:"type"`
+	// Host path (bind only), relative to the configuration file
+	Source string `json:"source,omitempty"`
+	// Absolute path in the rootfs
+	Target string `json:"target"`
+	// Mount options (e.g. "ro", "size=64M")
+	Options []string `json:"options,omitempty"`
+}
+
+type ImageConfigV1 struct {
+	// Environment variables in the form KEY=value
+	Env        []string          `json:"env,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// User name or ID, optionally with a group (e.g. "root", "1000:1000")
+	User       string `json:"user,omitempty"`
+	WorkingDir string `json:"working_dir,omitempty"`
+}
+
+type LXCTemplateV1 struct {
+	// The file in the container generated from the template (e.g. /etc/hostname)
+	Path string `json:"path"`
+	// The template file, relative to the configuration file
+	Template string `json:"template"`
+	// create, copy, or start
+	When       []string          `json:"when"`
+	CreateOnly bool              `json:"create_only,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type RuntimeConfigV1 struct {
+	// Namespaces to create (e.g. "pid", "network"). Default: all but user
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Capabilities of the process (e.g. "CAP_NET_ADMIN")
+	Capabilities []string `json:"capabilities,omitempty"`
+	Hostname     string   `json:"hostname,omitempty"`
+	Terminal     bool     `json:"terminal,omitempty"`
+	ReadOnly     bool     `json:"read_only,omitempty"`
+}
+
+type ConversionV1 struct {
+	// qcow2, vmdk, or vhdx
+	Format string `json:"format"`
+	// Compress the image (qcow2 only)
+	Compress bool `json:"compress,omitempty"`
+}
+
+type PartitionV1 struct {
+	// Partition label (GPT) and filesystem label
+	Name string `json:"name,omitempty"`
+	// Size in bytes, or with a binary suffix (e.g. "512M", "4G")
+	Size string `json:"size"`
+	// Partition type GUID (GPT) or ID (MBR), or an alias like "linux", or "esp"
+	Type       string `json:"type"`
+	Filesystem string `json:"filesystem"`
+	MountPoint string `json:"mount_point,omitempty"`
+	// Options for the fstab entry. Default: "defaults"
+	MountOptions string `json:"mount_options,omitempty"`
+	// The rootfs subtree copied into the filesystem. Defaults to the mount point.
+	Source string `json:"source,omitempty"`
+	// Sets the active flag (MBR only)
+	Bootable bool `json:"bootable,omitempty"`
+}
+
 func main() {
 	version := flag.Bool("version", false, "Print version information and exit")
 
@@ -72,9 +300,13 @@ func main() {
 		fmt.Println("  [CONFIG_FILE1, CONFIG_FILE2, ...]")
 		fmt.Println("    	One or more configuration files to be used by the rootfsbuilder")
 		fmt.Println()
+		fmt.Println("  cleanup")
+		fmt.Println("    	Unmount and remove the temporary directories of crashed builds")
+		fmt.Println()
 		fmt.Println("Examples:")
 		fmt.Println("  rootfsbuilder --version")
 		fmt.Println("  rootfsbuilder config1.yaml config2.yaml")
+		fmt.Println("  rootfsbuilder cleanup")
 	}
 
 	flag.Parse()
@@ -97,9 +329,48 @@ func main() {
 		os.Exit(ExitCodeFailure)
 	}
 
-	// Check if we have root privileges
-	if os.Geteuid() != 0 {
-		fmt.Fprintf(os.Stderr, "rootfsbuilder must be run as root\n")
+	// Without root privileges, the builder runs as root of a user namespace
+	rootless := os.Geteuid() != 0 && !inMountNamespace()
+
+	// Runs in the host's mount namespace, where the mounts of crashed builds
+	// are left
+	if len(nonFlagArgs) == 1 && nonFlagArgs[0] == "cleanup" {
+		removed, err := cleanupStaleDirs(os.TempDir(), os.Stderr)
+		for _, dir := range removed {
+			fmt.Printf("Removed %s\n", dir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error while cleaning up: %s\n", err)
+			os.Exit(ExitCodeFailure)
+		}
+		os.Exit(ExitCodeOK)
+	}
+
+	// Builds run in a private mount namespace, so that no mount outlives
+	// the builder.
+	if !inMountNamespace() {
+		run := runInMountNamespace
+		if rootless {
+			fmt.Fprintf(os.Stderr, "Not running as root, building rootless in a user namespace\n")
+			run = runInUserNamespace
+		}
+
+		code, err := run(os.Args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+		os.Exit(code)
+	}
+
+	if idMappingPending() {
+		if err = enterUserNamespace(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while setting up user namespace: %s\n", err)
+			os.Exit(ExitCodeFailure)
+		}
+	}
+
+	if err = makeMountsPrivate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while setting up mount namespace: %s\n", err)
 		os.Exit(ExitCodeFailure)
 	}
 
@@ -125,13 +396,16 @@ func main() {
 
 		builder := NewBuilder(config, debArch, workDir, os.Stdout, os.Stderr)
 
-		pkg, err := builder.Build()
+		results, err := builder.Build()
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error while building rootfs: %s\n", err)
 			os.Exit(ExitCodeFailure)
 		}
 
-		fmt.Printf("Successfully built rootfs: %s\n", pkg)
+		for _, result := range results {
+			fmt.Printf("Successfully built %s: %s\n", result.Type, strings.Join(result.Paths, ", "))
+		}
+		fmt.Printf("Release: %s\n", builder.releaseDescription())
 	}
 }
 
@@ -151,8 +425,32 @@ func parseConfiguration(path string) (*ConfigurationV1, error) {
 	// Lower string values were case distinction does not matter
 	config.Distribution = strings.ToLower(config.Distribution)
 	config.TarballType = strings.ToLower(config.TarballType)
+	config.Bootstrapper = strings.ToLower(config.Bootstrapper)
+	if config.FinalSources != nil {
+		config.FinalSources.Format = strings.ToLower(config.FinalSources.Format)
+	}
+	for i := range config.Mounts {
+		config.Mounts[i].Type = strings.ToLower(config.Mounts[i].Type)
+	}
+	for i := range config.Outputs {
+		output := &config.Outputs[i]
+		output.Type = strings.ToLower(output.Type)
+		output.PartitionTable = strings.ToLower(output.PartitionTable)
+		output.Format = strings.ToLower(output.Format)
+		output.RootfsType = strings.ToLower(output.RootfsType)
+		output.Compression = strings.ToLower(output.Compression)
+		output.Mode = strings.ToLower(output.Mode)
+		for j := range output.Partitions {
+			output.Partitions[j].Filesystem = strings.ToLower(output.Partitions[j].Filesystem)
+		}
+		for j := range output.Convert {
+			output.Convert[j].Format = strings.ToLower(output.Convert[j].Format)
+		}
+	}
 	config.absoluteConfigPath = path
 
+	applyDistributionProfile(&config)
+
 	if err = checkRequiredFields(&config); err != nil {
 		return nil, fmt.Errorf("error while checking required fields in configuration file '%s': %w", path, err)
 	}
@@ -208,15 +506,32 @@ func checkRequiredFields(config *ConfigurationV1) error {
 		return fmt.Errorf("architecture is required")
 	}
 
+	profile, err := lookupProfile(config.Distribution)
+	if err != nil {
+		return err
+	}
+	if err = profile.check(config.Distribution, config.Release, config.Architecture, DebootstrapScriptsDir); err != nil {
+		return err
+	}
+	if config.Preflight && profile.DebootstrapScript == "" {
+		return fmt.Errorf("preflight is only supported for Debian-based distributions")
+	}
+
 	if config.Mirror == "" {
 		return fmt.Errorf("mirror is required")
 	}
 
-	if config.TarballType == "" {
-		return fmt.Errorf("tarball type is required")
+	if config.FinalSources != nil {
+		if err = checkFinalSources(config.FinalSources, profile); err != nil {
+			return fmt.Errorf("invalid final sources in config with name '%s': %w", config.Name, err)
+		}
+	}
+
+	if config.TarballType == "" && len(config.Outputs) == 0 {
+		return fmt.Errorf("tarball type or outputs are required")
 	}
 
-	if config.TarballType != TarballTypeTar && config.TarballType != TarballTypeTarGz {
+	if config.TarballType != "" && config.TarballType != TarballTypeTar && config.TarballType != TarballTypeTarGz {
 		return fmt.Errorf("unsupported tarball type in config with name '%s': %s", config.Name, config.TarballType)
 	}
 
@@ -224,5 +539,90 @@ func checkRequiredFields(config *ConfigurationV1) error {
 		return fmt.Errorf("unsupported payload type in config with name '%s': %s", config.Name, config.PayloadType)
 	}
 
+	if err := checkBootstrap(config, isRootless()); err != nil {
+		return fmt.Errorf("invalid bootstrap configuration in config with name '%s': %w", config.Name, err)
+	}
+
+	if (config.AptProxy != "" || len(config.BuildFiles) > 0) && config.PostInstallCommand == "" {
+		return fmt.Errorf("apt proxy and build files require a post install command in config with name '%s'", config.Name)
+	}
+
+	for i := range config.BuildFiles {
+		if err := checkBuildFile(&config.BuildFiles[i]); err != nil {
+			return fmt.Errorf("invalid build file %d in config with name '%s': %w", i+1, config.Name, err)
+		}
+	}
+
+	if err := checkMounts(config.Mounts); err != nil {
+		return fmt.Errorf("invalid mounts in config with name '%s': %w", config.Name, err)
+	}
+
+	// Outputs of the same type would overwrite each other's artifacts
+	names := map[string]bool{}
+	if config.TarballType != "" {
+		names[OutputTypeTar+"/"] = true
+	}
+
+	for i := range config.Outputs {
+		output := &config.Outputs[i]
+		if err := checkOutput(output); err != nil {
+			return fmt.Errorf("invalid output %d in config with name '%s': %w", i+1, config.Name, err)
+		}
+
+		// Later outputs are built from the rootfs
+		if output.Type == OutputTypeDirectory && output.Mode == DirectoryModeMove && i != len(config.Outputs)-1 {
+			return fmt.Errorf("invalid output %d in config with name '%s': moving the rootfs is only supported for the last output", i+1, config.Name)
+		}
+
+		key := output.Type + "/" + output.Name
+		if names[key] {
+			return fmt.Errorf("invalid output %d in config with name '%s': duplicate %s output, set a distinct name", i+1, config.Name, output.Type)
+		}
+		names[key] = true
+	}
+
 	return nil
 }
+
+func checkOutput(output *OutputV1) error {
+	if len(output.Convert) > 0 && output.Type != OutputTypeDisk {
+		return fmt.Errorf("conversion is only supported for disk images")
+	}
+
+	if !validOutputName.MatchString(output.Name) {
+		return fmt.Errorf("output name '%s' may only contain letters, digits, '.', '_', and '-'", output.Name)
+	}
+
+	if err := checkExcludes(output.Exclude); err != nil {
+		return err
+	}
+
+	switch output.Type {
+	case OutputTypeTar:
+		return checkTarOutput(output)
+	case OutputTypeExt4:
+		return checkExt4Output(output)
+	case OutputTypeSquashfs:
+		return checkSquashfsOutput(output)
+	case OutputTypeDirectory:
+		return checkDirectoryOutput(output)
+	case OutputTypeDisk:
+		return checkDiskOutput(output)
+	case OutputTypeFat:
+		return checkFatOutput(output)
+	case OutputTypeOCI:
+		return checkOCIOutput(output)
+	case OutputTypeDocker:
+		return checkDockerOutput(output)
+	case OutputTypeBundle:
+		return checkBundleOutput(output)
+	case OutputTypeLXC:
+		return checkLXCOutput(output)
+	case OutputTypeCpio:
+		return checkCpioOutput(output)
+	case "":
+		return fmt.Errorf("output type is required")
+	}
+
+	return fmt.Errorf("unsupported output type: %s", output.Type)
+}
@@ -0,0 +1,413 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	MountInfoPath = "/proc/self/mountinfo"
+	// Number of unmount passes before falling back to lazy unmounts
+	UnmountRetries    = 3
+	UnmountRetryDelay = 500 * time.Millisecond
+)
+
+// Decodes the octal escapes (e.g. "\040" for a space) of a mountinfo field
+func unescapeMountInfo(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) && isOctal(field[i+1]) && isOctal(field[i+2]) && isOctal(field[i+3]) {
+			sb.WriteByte((field[i+1]-'0')<<6 | (field[i+2]-'0')<<3 | (field[i+3] - '0'))
+			i += 3
+			continue
+		}
+		sb.WriteByte(field[i])
+	}
+
+	return sb.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// Returns the mount points listed in a mountinfo file, in mount order
+func parseMountInfo(r io.Reader) ([]string, error) {
+	mountPoints := []string{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("malformed mountinfo line: '%s'", scanner.Text())
+		}
+		mountPoints = append(mountPoints, unescapeMountInfo(fields[4]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mountPoints, nil
+}
+
+// Returns the mount points at or below root, deepest first. Mounts stacked
+// on the same mount point are listed once per mount, the topmost first.
+func filterMountsUnder(mountPoints []string, root string) []string {
+	mounts := []string{}
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		mountPoint := mountPoints[i]
+		if mountPoint == root || strings.HasPrefix(mountPoint, root+"/") {
+			mounts = append(mounts, mountPoint)
+		}
+	}
+
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return strings.Count(mounts[i], "/") > strings.Count(mounts[j], "/")
+	})
+
+	return mounts
+}
+
+// Returns the mount points at or below root in the current mount namespace,
+// including those created by the post install command (e.g. binfmt_misc).
+// Nothing is mounted below a root that does not exist (anymore).
+func mountsUnder(root string) ([]string, error) {
+	// Mount points are listed with symlinks resolved
+	resolved, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving '%s': %w", root, err)
+	}
+
+	fd, err := os.Open(MountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading mount table: %w", err)
+	}
+	defer fd.Close()
+
+	mountPoints, err := parseMountInfo(fd)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading mount table: %w", err)
+	}
+
+	return filterMountsUnder(mountPoints, filepath.Clean(resolved)), nil
+}
+
+// Unmounts everything at or below root, deepest first. Busy mounts are
+// retried, and detached lazily as a last resort, which also covers the
+// locked submounts of recursive bind mounts in a user namespace. Returns an
+// error if anything is still mounted afterwards.
+func unmountAll(root string, logger io.Writer) error {
+	for attempt := 0; attempt < UnmountRetries; attempt++ {
+		mounts, err := mountsUnder(root)
+		if err != nil {
+			return err
+		}
+		if len(mounts) == 0 {
+			return nil
+		}
+
+		if attempt > 0 {
+			time.Sleep(UnmountRetryDelay)
+		}
+
+		// Only busy mounts are worth retrying
+		busy := false
+		for _, mountPoint := range mounts {
+			if err = syscall.Unmount(mountPoint, 0); err == syscall.EBUSY {
+				busy = true
+			}
+		}
+		if !busy {
+			break
+		}
+	}
+
+	mounts, err := mountsUnder(root)
+	if err != nil {
+		return err
+	}
+
+	// Shallowest first, detaching a mount detaches all mounts below it
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err = syscall.Unmount(mounts[i], syscall.MNT_DETACH); err == nil {
+			fmt.Fprintf(logger, "Detached '%s'\n", mounts[i])
+		}
+	}
+
+	mounts, err = mountsUnder(root)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("still mounted: %s", strings.Join(mounts, ", "))
+	}
+
+	return nil
+}
+
+// Removes a directory after unmounting everything in it. The directory is
+// not removed if anything is still mounted, as removing e.g. a bind mount of
+// /dev would remove the host's device nodes. A directory that was already
+// removed or moved away (e.g. by a directory output) is left alone.
+func removeUnmounted(dir string, logger io.Writer) error {
+	if err := unmountAll(dir, logger); err != nil {
+		return fmt.Errorf("not removing '%s': %w", dir, err)
+	}
+
+	return os.RemoveAll(dir)
+}
+
+// Mounted for the post install command unless replaced in the configuration
+var defaultMounts = []MountV1{
+	{Type: MountTypeProc, Target: "/proc"},
+	{Type: MountTypeSysfs, Target: "/sys"},
+	{Type: MountTypeBind, Source: "/dev", Target: "/dev"},
+	{Type: MountTypeDevpts, Target: "/dev/pts", Options: []string{"newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+	{Type: MountTypeTmpfs, Target: "/run", Options: []string{"mode=0755", "nosuid", "nodev"}},
+}
+
+// sysfs cannot be mounted in a user namespace without a network namespace,
+// and the host's /dev and /sys contain mounts that can only be bound
+// recursively there
+var rootlessDefaultMounts = []MountV1{
+	{Type: MountTypeProc, Target: "/proc"},
+	{Type: MountTypeBind, Source: "/sys", Target: "/sys", Options: []string{"rbind"}},
+	{Type: MountTypeBind, Source: "/dev", Target: "/dev", Options: []string{"rbind"}},
+	{Type: MountTypeDevpts, Target: "/dev/pts", Options: []string{"newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+	{Type: MountTypeTmpfs, Target: "/run", Options: []string{"mode=0755", "nosuid", "nodev"}},
+}
+
+func checkMounts(mounts []MountV1) error {
+	targets := map[string]bool{}
+
+	for i, mount := range mounts {
+		switch mount.Type {
+		case MountTypeProc, MountTypeSysfs, MountTypeDevpts, MountTypeTmpfs, MountTypeNone:
+			if mount.Source != "" {
+				return fmt.Errorf("mount %d: source is only supported for bind mounts", i+1)
+			}
+		case MountTypeBind:
+			if mount.Source == "" {
+				return fmt.Errorf("mount %d: source is required for bind mounts", i+1)
+			}
+		case "":
+			return fmt.Errorf("mount %d: type is required", i+1)
+		default:
+			return fmt.Errorf("mount %d: unsupported type: %s", i+1, mount.Type)
+		}
+
+		if !path.IsAbs(mount.Target) {
+			return fmt.Errorf("mount %d: target must be an absolute path: '%s'", i+1, mount.Target)
+		}
+		if path.Clean(mount.Target) == "/" {
+			return fmt.Errorf("mount %d: cannot mount over the root directory", i+1)
+		}
+		for _, component := range strings.Split(mount.Target, "/") {
+			if component == ".." {
+				return fmt.Errorf("mount %d: target must not contain '..': '%s'", i+1, mount.Target)
+			}
+		}
+
+		for _, option := range mount.Options {
+			if option == "" || strings.Contains(option, ",") {
+				return fmt.Errorf("mount %d: invalid option '%s', use one list entry per option", i+1, option)
+			}
+		}
+
+		target := path.Clean(mount.Target)
+		if targets[target] {
+			return fmt.Errorf("mount %d: duplicate target '%s'", i+1, target)
+		}
+		targets[target] = true
+	}
+
+	return nil
+}
+
+// Returns the mounts for the post install command, in mount order. A
+// configured mount replaces the default mount with the same target (type
+// none removes it). Other configured mounts follow the defaults.
+func effectiveMounts(configured []MountV1, rootless bool) []MountV1 {
+	defaults := defaultMounts
+	if rootless {
+		defaults = rootlessDefaultMounts
+	}
+
+	overrides := map[string]MountV1{}
+	for _, mount := range configured {
+		overrides[path.Clean(mount.Target)] = mount
+	}
+
+	mounts := []MountV1{}
+	for _, mount := range defaults {
+		if override, ok := overrides[mount.Target]; ok {
+			delete(overrides, mount.Target)
+			mount = override
+		}
+		if mount.Type != MountTypeNone {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	for _, mount := range configured {
+		if _, ok := overrides[path.Clean(mount.Target)]; ok && mount.Type != MountTypeNone {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	return mounts
+}
+
+// Returns the path of a mount target in the rootfs, creating it if needed.
+// Symlinks are rejected, as they would be resolved on the host. Below a
+// bind mount, the target must exist, as it would be created on the host
+// (e.g. in /dev).
+func (b *Builder) mountTarget(target string, sourceIsDir bool) (string, error) {
+	bindTarget := ""
+	for _, mounted := range b.bindMountTargets {
+		if _, ok := relativeSubpath(mounted, path.Clean(target)); ok {
+			bindTarget = mounted
+		}
+	}
+
+	current := b.rootfs
+	components := strings.Split(strings.Trim(path.Clean(target), "/"), "/")
+
+	for i, component := range components {
+		current = filepath.Join(current, component)
+		last := i == len(components)-1
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) && bindTarget != "" {
+			return "", fmt.Errorf("'%s' does not exist below bind mount '%s'", target, bindTarget)
+		} else if os.IsNotExist(err) {
+			if last && !sourceIsDir {
+				fd, err := os.OpenFile(current, os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					return "", err
+				}
+				fd.Close()
+			} else if err = os.Mkdir(current, 0755); err != nil {
+				return "", err
+			}
+			b.createdMountTargets = append(b.createdMountTargets, current)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("'%s' is a symlink in the rootfs", path.Join(components[:i+1]...))
+		}
+	}
+
+	return current, nil
+}
+
+// Removes the mount targets created in the rootfs, deepest first, so that
+// they do not end up in the outputs. Directories the post install command
+// wrote into are kept.
+func (b *Builder) removeCreatedMountTargets() error {
+	for i := len(b.createdMountTargets) - 1; i >= 0; i-- {
+		created := b.createdMountTargets[i]
+		if err := os.Remove(created); err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTEMPTY) && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("error while removing mount target '%s': %w", created, err)
+		}
+	}
+	b.createdMountTargets = nil
+
+	return nil
+}
+
+// Mounts a filesystem into the rootfs. Mounts are released by
+// unmountRootfs, or on teardown.
+func (b *Builder) mountInRootfs(mount MountV1) error {
+	source := mount.Source
+	sourceIsDir := true
+	if mount.Type == MountTypeBind {
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(filepath.Dir(b.config.absoluteConfigPath), source)
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return fmt.Errorf("error while checking bind mount source: %w", err)
+		}
+		sourceIsDir = info.IsDir()
+	} else {
+		source = mount.Type
+	}
+
+	target, err := b.mountTarget(mount.Target, sourceIsDir)
+	if err != nil {
+		return fmt.Errorf("error while creating mount target '%s': %w", mount.Target, err)
+	}
+
+	readOnly := false
+	options := []string{}
+	for _, option := range mount.Options {
+		if mount.Type == MountTypeBind && option == "ro" {
+			readOnly = true
+			continue
+		}
+		options = append(options, option)
+	}
+
+	args := []string{}
+	if mount.Type == MountTypeBind {
+		recursive := false
+		for _, option := range options {
+			recursive = recursive || option == "rbind"
+		}
+		if !recursive {
+			options = append([]string{"bind"}, options...)
+		}
+	} else {
+		args = append(args, "-t", mount.Type)
+	}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+
+	if err = b.runCommand(exec.Command("mount", args...)); err != nil {
+		return fmt.Errorf("mounting %s on '%s': %w", mount.Type, mount.Target, err)
+	}
+
+	// Bind mounts ignore "ro" on creation, and are made read-only by a
+	// remount
+	if readOnly {
+		if err = b.runCommand(exec.Command("mount", "-o", "remount,bind,ro", target)); err != nil {
+			return fmt.Errorf("remounting '%s' read-only: %w", mount.Target, err)
+		}
+	}
+	if mount.Type == MountTypeBind {
+		b.bindMountTargets = append(b.bindMountTargets, path.Clean(mount.Target))
+	}
+
+	return nil
+}
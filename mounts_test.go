@@ -0,0 +1,300 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 0:5 / /tmp/rootfsbuilder-1/proc rw,nosuid - proc none rw
+41 22 0:20 / /tmp/rootfsbuilder-1/sys rw,nosuid - sysfs none rw
+42 22 0:6 / /tmp/rootfsbuilder-1/dev rw,nosuid - devtmpfs udev rw
+43 40 0:44 / /tmp/rootfsbuilder-1/proc/sys/fs/binfmt_misc rw - binfmt_misc binfmt_misc rw
+44 22 0:45 / /tmp/rootfsbuilder-1/run rw - tmpfs tmpfs rw
+45 44 0:46 / /tmp/rootfsbuilder-1/run rw - tmpfs tmpfs rw
+46 22 0:47 / /tmp/rootfsbuilder-10 rw - tmpfs tmpfs rw
+47 22 0:48 / /tmp/rootfsbuilder-1/mnt/build\040cache ro - ext4 /dev/sdb1 ro
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mountPoints, err := parseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if len(mountPoints) != 9 {
+		t.Fatalf("expected 9 mount points, got: %v", mountPoints)
+	}
+	if mountPoints[8] != "/tmp/rootfsbuilder-1/mnt/build cache" {
+		t.Errorf("expected escaped space to be decoded, got '%s'", mountPoints[8])
+	}
+
+	if _, err = parseMountInfo(strings.NewReader("22 1 8:1\n")); err == nil {
+		t.Error("expected error for malformed line")
+	}
+}
+
+func TestFilterMountsUnder(t *testing.T) {
+	mountPoints, err := parseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := filterMountsUnder(mountPoints, "/tmp/rootfsbuilder-1")
+	expected := []string{
+		"/tmp/rootfsbuilder-1/proc/sys/fs/binfmt_misc",
+		"/tmp/rootfsbuilder-1/mnt/build cache",
+		"/tmp/rootfsbuilder-1/run",
+		"/tmp/rootfsbuilder-1/run",
+		"/tmp/rootfsbuilder-1/dev",
+		"/tmp/rootfsbuilder-1/sys",
+		"/tmp/rootfsbuilder-1/proc",
+	}
+
+	if strings.Join(mounts, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, mounts)
+	}
+}
+
+func TestUnmountAll(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	root := t.TempDir()
+	if err := os.Mkdir(root+"/run", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", root+"/run", "tmpfs", 0, ""); err != nil {
+		t.Skipf("tmpfs not mountable: %s", err)
+	}
+	// Nested mount, as created by a post install script
+	if err := os.Mkdir(root+"/run/lock", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", root+"/run/lock", "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if mounts, err := mountsUnder(root); err != nil || len(mounts) != 2 {
+		t.Fatalf("expected 2 mounts, got: %v, %v", mounts, err)
+	}
+
+	if err := removeUnmounted(root, io.Discard); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Error("expected directory to be removed")
+	}
+}
+
+func TestRemoveUnmountedMissingDirectory(t *testing.T) {
+	dir := t.TempDir() + "/moved"
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir, dir+"-target"); err != nil {
+		t.Fatal(err)
+	}
+
+	if mounts, err := mountsUnder(dir); err != nil || len(mounts) != 0 {
+		t.Errorf("expected no mounts, got: %v, %v", mounts, err)
+	}
+	if err := removeUnmounted(dir, io.Discard); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if _, err := os.Stat(dir + "-target"); err != nil {
+		t.Errorf("expected moved directory to be kept: %s", err)
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	valid := []MountV1{
+		{Type: MountTypeBind, Source: "/var/cache/apt", Target: "/var/cache/apt", Options: []string{"ro"}},
+		{Type: MountTypeTmpfs, Target: "/tmp", Options: []string{"size=64M"}},
+		{Type: MountTypeNone, Target: "/run"},
+	}
+	if err := checkMounts(valid); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	invalid := map[string]MountV1{
+		"missing type":     {Target: "/tmp"},
+		"unsupported type": {Type: "nfs", Target: "/mnt"},
+		"bind no source":   {Type: MountTypeBind, Target: "/src"},
+		"tmpfs source":     {Type: MountTypeTmpfs, Source: "/tmp", Target: "/tmp"},
+		"relative target":  {Type: MountTypeTmpfs, Target: "tmp"},
+		"root target":      {Type: MountTypeTmpfs, Target: "/"},
+		"escaping target":  {Type: MountTypeTmpfs, Target: "/tmp/../../etc"},
+		"joined options":   {Type: MountTypeTmpfs, Target: "/tmp", Options: []string{"size=64M,mode=1777"}},
+	}
+	for name, mount := range invalid {
+		if err := checkMounts([]MountV1{mount}); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	duplicate := []MountV1{{Type: MountTypeTmpfs, Target: "/tmp"}, {Type: MountTypeTmpfs, Target: "/tmp/"}}
+	if err := checkMounts(duplicate); err == nil {
+		t.Error("expected error for duplicate target")
+	}
+}
+
+func TestEffectiveMounts(t *testing.T) {
+	mounts := effectiveMounts(nil, false)
+	if len(mounts) != len(defaultMounts) {
+		t.Fatalf("expected default mounts, got: %v", mounts)
+	}
+
+	mounts = effectiveMounts([]MountV1{
+		{Type: MountTypeBind, Source: "cache", Target: "/var/cache/apt"},
+		{Type: MountTypeTmpfs, Target: "/run/", Options: []string{"size=16M"}},
+		{Type: MountTypeNone, Target: "/dev/pts"},
+	}, false)
+
+	targets := []string{}
+	for _, mount := range mounts {
+		targets = append(targets, mount.Target)
+	}
+	if strings.Join(targets, ",") != "/proc,/sys,/dev,/run/,/var/cache/apt" {
+		t.Errorf("unexpected mount order: %v", targets)
+	}
+	if len(mounts[3].Options) != 1 || mounts[3].Options[0] != "size=16M" {
+		t.Errorf("expected /run to be replaced, got: %+v", mounts[3])
+	}
+}
+
+func TestEffectiveMountsRootless(t *testing.T) {
+	for _, mount := range effectiveMounts(nil, true) {
+		if mount.Type == MountTypeSysfs {
+			t.Error("expected sysfs to be bind mounted in a user namespace")
+		}
+		if mount.Type == MountTypeBind && (len(mount.Options) != 1 || mount.Options[0] != "rbind") {
+			t.Errorf("expected recursive bind mount of '%s'", mount.Source)
+		}
+	}
+}
+
+func TestMountTargetRejectsSymlinks(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	if err := os.Symlink("/", builder.rootfs+"/host"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := builder.mountTarget("/host/mnt", true); err == nil {
+		t.Error("expected error for symlink in target")
+	}
+
+	target, err := builder.mountTarget("/etc/resolv.conf", false)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if info, err := os.Stat(target); err != nil || !info.Mode().IsRegular() {
+		t.Error("expected file target to be created")
+	}
+}
+
+func TestMountTargetsRemoved(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	if _, err := builder.mountTarget("/etc/apt/apt.conf.d/proxy", false); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err := builder.mountTarget("/var/cache/apt", true); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := builder.unmountRootfs(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	// Only the rootfs created by newTestRootfsBuilder remains
+	entries := []string{}
+	err := filepath.Walk(builder.rootfs, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		entries = append(entries, strings.TrimPrefix(filePath, builder.rootfs))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(entries, ",") != ",/etc,/etc/hostname" {
+		t.Errorf("expected mount targets to be removed, got: %v", entries)
+	}
+}
+
+func TestMountTargetBelowBindMount(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	if err := os.MkdirAll(builder.rootfs+"/dev/pts", 0755); err != nil {
+		t.Fatal(err)
+	}
+	builder.bindMountTargets = []string{"/dev"}
+
+	if _, err := builder.mountTarget("/dev/pts", true); err != nil {
+		t.Errorf("expected existing target to be used, got: %s", err)
+	}
+	if _, err := builder.mountTarget("/dev/shm/cache", true); err == nil {
+		t.Error("expected error for missing target below bind mount")
+	}
+	if _, err := os.Stat(builder.rootfs + "/dev/shm"); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be created below bind mount, got: %v", err)
+	}
+}
+
+func TestMountAux(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	builder := newTestRootfsBuilder(t)
+	source := t.TempDir()
+	if err := os.WriteFile(source+"/README", []byte("source"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builder.config.absoluteConfigPath = filepath.Join(filepath.Dir(source), "config.json")
+	builder.config.Mounts = []MountV1{
+		{Type: MountTypeNone, Target: "/proc"},
+		{Type: MountTypeNone, Target: "/sys"},
+		{Type: MountTypeNone, Target: "/dev"},
+		{Type: MountTypeNone, Target: "/dev/pts"},
+		{Type: MountTypeBind, Source: filepath.Base(source), Target: "/usr/src", Options: []string{"ro"}},
+	}
+
+	if err := builder.mountAux(); err != nil {
+		t.Skipf("mounting failed: %s", err)
+	}
+	defer builder.unmountRootfs()
+
+	if data, err := os.ReadFile(builder.rootfs + "/usr/src/README"); err != nil || string(data) != "source" {
+		t.Errorf("expected bind mounted source, got: %q, %v", data, err)
+	}
+	if err := os.WriteFile(builder.rootfs+"/usr/src/new", nil, 0644); err == nil {
+		t.Error("expected bind mount to be read-only")
+	}
+	if err := os.WriteFile(builder.rootfs+"/run/new", nil, 0644); err != nil {
+		t.Errorf("expected writable /run, got: %s", err)
+	}
+
+	if err := builder.unmountRootfs(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if mounts, err := mountsUnder(builder.rootfs); err != nil || len(mounts) != 0 {
+		t.Errorf("expected everything to be unmounted, got: %v, %v", mounts, err)
+	}
+	for _, target := range []string{"/usr", "/run"} {
+		if _, err := os.Stat(builder.rootfs + target); !os.IsNotExist(err) {
+			t.Errorf("expected created mount target '%s' to be removed, got: %v", target, err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+const (
+	// Set in the environment of the re-executed builder
+	MountNamespaceEnv = "ROOTFSBUILDER_MOUNT_NAMESPACE"
+)
+
+// Reports whether the process runs in the private mount namespace created
+// by runInMountNamespace.
+func inMountNamespace() bool {
+	return os.Getenv(MountNamespaceEnv) == "1"
+}
+
+// Returns a command that re-executes the builder with the same arguments
+// in a new mount namespace.
+func newMountNamespaceCommand(args []string) *exec.Cmd {
+	cmd := exec.Command("/proc/self/exe", args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Env = append(os.Environ(), MountNamespaceEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Unshareflags: syscall.CLONE_NEWNS,
+		// Do not outlive the parent
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	return cmd
+}
+
+// Re-executes the builder in a private mount namespace and waits for it.
+// All mounts of the build are made in this namespace, so they disappear
+// with the builder, however it exits. Returns the exit code of the builder.
+func runInMountNamespace(args []string) (int, error) {
+	cmd := newMountNamespaceCommand(args)
+
+	// The builder handles signals itself. SIGINT from the terminal is sent
+	// to the whole process group, so it is not forwarded. Ignoring it
+	// instead would be inherited by the builder.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return ExitCodeFailure, fmt.Errorf("error while creating mount namespace: %w", err)
+	}
+
+	return waitForBuilder(cmd, signals)
+}
+
+// Waits for the re-executed builder, forwarding all signals but SIGINT.
+// Returns its exit code, 128 plus the signal number if it was killed.
+func waitForBuilder(cmd *exec.Cmd, signals chan os.Signal) (int, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != syscall.SIGINT {
+					_ = cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return ExitCodeFailure, err
+	}
+
+	return ExitCodeOK, nil
+}
+
+// Makes all mounts in the namespace private, so that no mount or unmount
+// propagates to the host. The new namespace is a copy of the host's, where
+// mounts are usually shared (e.g. with systemd).
+func makeMountsPrivate() error {
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("error while making mounts private: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNewMountNamespaceCommand(t *testing.T) {
+	cmd := newMountNamespaceCommand([]string{"rootfsbuilder", "config.json"})
+
+	if cmd.Path != "/proc/self/exe" {
+		t.Errorf("expected the builder to be re-executed, got: %s", cmd.Path)
+	}
+	if len(cmd.Args) != 2 || cmd.Args[0] != "rootfsbuilder" || cmd.Args[1] != "config.json" {
+		t.Errorf("expected arguments to be passed on, got: %v", cmd.Args)
+	}
+	if cmd.SysProcAttr.Unshareflags&syscall.CLONE_NEWNS == 0 {
+		t.Error("expected a new mount namespace")
+	}
+	if cmd.Env[len(cmd.Env)-1] != MountNamespaceEnv+"=1" {
+		t.Error("expected the re-executed builder to be marked")
+	}
+}
+
+func TestInMountNamespace(t *testing.T) {
+	original, set := os.LookupEnv(MountNamespaceEnv)
+	defer func() {
+		if set {
+			os.Setenv(MountNamespaceEnv, original)
+		} else {
+			os.Unsetenv(MountNamespaceEnv)
+		}
+	}()
+
+	os.Unsetenv(MountNamespaceEnv)
+	if inMountNamespace() {
+		t.Error("expected not to be in the mount namespace")
+	}
+
+	os.Setenv(MountNamespaceEnv, "1")
+	if !inMountNamespace() {
+		t.Error("expected to be in the mount namespace")
+	}
+}
@@ -0,0 +1,417 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OCI image specification media types
+const (
+	OCIMediaTypeIndex     = "application/vnd.oci.image.index.v1+json"
+	OCIMediaTypeManifest  = "application/vnd.oci.image.manifest.v1+json"
+	OCIMediaTypeConfig    = "application/vnd.oci.image.config.v1+json"
+	OCIMediaTypeLayer     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	OCIImageLayoutVersion = "1.0.0"
+
+	DefaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociImageConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+}
+
+type ociRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type ociHistory struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+type ociImage struct {
+	Created      string         `json:"created"`
+	Architecture string         `json:"architecture"`
+	Variant      string         `json:"variant,omitempty"`
+	OS           string         `json:"os"`
+	Config       ociImageConfig `json:"config"`
+	RootFS       ociRootFS      `json:"rootfs"`
+	History      []ociHistory   `json:"history"`
+}
+
+func checkOCIOutput(output *OutputV1) error {
+	if output.Format != "" && output.Format != OutputFormatDir && output.Format != OutputFormatTar {
+		return fmt.Errorf("unsupported format '%s'", output.Format)
+	}
+	if output.Tag != "" && !validReference.MatchString(output.Tag) {
+		return fmt.Errorf("malformed image reference '%s'", output.Tag)
+	}
+
+	return checkImageConfig(&output.Image)
+}
+
+func checkImageConfig(image *ImageConfigV1) error {
+	for _, env := range image.Env {
+		if !strings.Contains(env, "=") || strings.HasPrefix(env, "=") {
+			return fmt.Errorf("environment variable '%s' is not in the form KEY=value", env)
+		}
+	}
+
+	if image.WorkingDir != "" && !strings.HasPrefix(image.WorkingDir, "/") {
+		return fmt.Errorf("working directory '%s' is not absolute", image.WorkingDir)
+	}
+
+	return nil
+}
+
+// Returns the environment with a default PATH
+func imageEnv(image *ImageConfigV1) []string {
+	for _, env := range image.Env {
+		if strings.HasPrefix(env, "PATH=") {
+			return image.Env
+		}
+	}
+
+	return append([]string{DefaultPathEnv}, image.Env...)
+}
+
+// Writes blobs into a content addressable store (blobs/sha256)
+type blobWriter struct {
+	fd     *os.File
+	hasher hash.Hash
+	size   int64
+	dir    string
+}
+
+func newBlobWriter(blobDir string) (*blobWriter, error) {
+	fd, err := os.CreateTemp(blobDir, ".blob-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &blobWriter{fd: fd, hasher: sha256.New(), dir: blobDir}, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.fd.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Moves the blob to its digest and returns a descriptor for it
+func (w *blobWriter) Commit(mediaType string) (ociDescriptor, error) {
+	if err := w.fd.Close(); err != nil {
+		os.Remove(w.fd.Name())
+		return ociDescriptor{}, err
+	}
+
+	// Temporary files are only accessible by the owner
+	if err := os.Chmod(w.fd.Name(), 0644); err != nil {
+		os.Remove(w.fd.Name())
+		return ociDescriptor{}, err
+	}
+
+	encoded := hex.EncodeToString(w.hasher.Sum(nil))
+	if err := os.Rename(w.fd.Name(), filepath.Join(w.dir, encoded)); err != nil {
+		os.Remove(w.fd.Name())
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + encoded, Size: w.size}, nil
+}
+
+func (w *blobWriter) Abort() {
+	w.fd.Close()
+	os.Remove(w.fd.Name())
+}
+
+func writeJSONBlob(blobDir string, mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	w, err := newBlobWriter(blobDir)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err = w.Write(data); err != nil {
+		w.Abort()
+		return ociDescriptor{}, err
+	}
+
+	return w.Commit(mediaType)
+}
+
+// Writes the rootfs as a gzip compressed layer blob. Returns the layer
+// descriptor and the digest of the uncompressed tarball (diff ID).
+func (b *Builder) writeLayerBlob(blobDir string) (ociDescriptor, string, error) {
+	w, err := newBlobWriter(blobDir)
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("error while creating layer blob: %w", err)
+	}
+
+	diffHasher := sha256.New()
+	gz := gzip.NewWriter(w)
+
+	if err = b.writeRootfsTar(io.MultiWriter(gz, diffHasher), nil); err != nil {
+		w.Abort()
+		return ociDescriptor{}, "", err
+	}
+
+	if err = gz.Close(); err != nil {
+		w.Abort()
+		return ociDescriptor{}, "", fmt.Errorf("error while compressing layer: %w", err)
+	}
+
+	layer, err := w.Commit(OCIMediaTypeLayer)
+	if err != nil {
+		return ociDescriptor{}, "", fmt.Errorf("error while writing layer blob: %w", err)
+	}
+
+	return layer, "sha256:" + hex.EncodeToString(diffHasher.Sum(nil)), nil
+}
+
+// Returns the image configuration for the rootfs
+func (b *Builder) newOCIImage(image *ImageConfigV1, diffID string) (*ociImage, error) {
+	arch, variant, err := DebToOCIArch(b.config.Architecture)
+	if err != nil {
+		return nil, err
+	}
+
+	config := ociImageConfig{
+		Env:        imageEnv(image),
+		Entrypoint: image.Entrypoint,
+		Cmd:        image.Cmd,
+		Labels:     image.Labels,
+		User:       image.User,
+		WorkingDir: image.WorkingDir,
+	}
+
+	if len(config.Entrypoint) == 0 && len(config.Cmd) == 0 {
+		config.Cmd = []string{"/bin/sh"}
+	}
+
+	created := b.buildTime.UTC().Format(time.RFC3339)
+
+	return &ociImage{
+		Created:      created,
+		Architecture: arch,
+		Variant:      variant,
+		OS:           "linux",
+		Config:       config,
+		RootFS:       ociRootFS{Type: "layers", DiffIDs: []string{diffID}},
+		History: []ociHistory{
+			{Created: created, CreatedBy: fmt.Sprintf("rootfsbuilder %s (%s)", Version, b.config.Name)},
+		},
+	}, nil
+}
+
+// Returns the path of a blob relative to the image layout
+func blobPath(descriptor ociDescriptor) string {
+	return "blobs/sha256/" + strings.TrimPrefix(descriptor.Digest, "sha256:")
+}
+
+// Writes an OCI image layout into layoutDir, which must exist. The image
+// is tagged with refName. Returns the image manifest.
+func (b *Builder) writeOCILayout(output *OutputV1, layoutDir string, refName string) (*ociManifest, error) {
+	blobDir := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return nil, fmt.Errorf("error while creating blob directory: %w", err)
+	}
+
+	layer, diffID, err := b.writeLayerBlob(blobDir)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := b.newOCIImage(&output.Image, diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := writeJSONBlob(blobDir, OCIMediaTypeConfig, image)
+	if err != nil {
+		return nil, fmt.Errorf("error while writing image configuration: %w", err)
+	}
+
+	manifest := &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     OCIMediaTypeManifest,
+		Config:        config,
+		Layers:        []ociDescriptor{layer},
+	}
+
+	manifestDescriptor, err := writeJSONBlob(blobDir, OCIMediaTypeManifest, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error while writing image manifest: %w", err)
+	}
+
+	manifestDescriptor.Platform = &ociPlatform{Architecture: image.Architecture, OS: image.OS, Variant: image.Variant}
+	manifestDescriptor.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": refName,
+		"org.opencontainers.image.created":  image.Created,
+	}
+
+	index, err := json.Marshal(&ociIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIMediaTypeIndex,
+		Manifests:     []ociDescriptor{manifestDescriptor},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.WriteFile(filepath.Join(layoutDir, "index.json"), index, 0644); err != nil {
+		return nil, fmt.Errorf("error while writing index: %w", err)
+	}
+
+	layout := fmt.Sprintf("{\"imageLayoutVersion\":\"%s\"}", OCIImageLayoutVersion)
+	if err = os.WriteFile(filepath.Join(layoutDir, "oci-layout"), []byte(layout), 0644); err != nil {
+		return nil, fmt.Errorf("error while writing oci-layout: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// Builds an OCI image layout directory, or a tarball of it. The image is
+// tagged with the tag of the configured reference, or the release.
+func (b *Builder) buildOCIImage(output *OutputV1, imagePath string) error {
+	refName := b.config.Release
+	if output.Tag != "" {
+		refName = referenceTag(output.Tag)
+	}
+
+	if output.Format != OutputFormatTar {
+		if err := os.Mkdir(imagePath, 0755); err != nil {
+			return fmt.Errorf("error while creating image layout directory: %w", err)
+		}
+
+		_, err := b.writeOCILayout(output, imagePath, refName)
+		return err
+	}
+
+	workDir, removeWorkDir, err := b.makeTempDir(os.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		return err
+	}
+	defer removeWorkDir()
+
+	if _, err = b.writeOCILayout(output, workDir, refName); err != nil {
+		return err
+	}
+
+	return writeDirectoryTar(workDir, imagePath)
+}
+
+// Writes a tarball of a directory that only contains regular files and
+// directories, with normalised ownership.
+func writeDirectoryTar(dir string, tarballPath string) error {
+	fd, err := os.Create(tarballPath)
+	if err != nil {
+		return fmt.Errorf("error while creating tarball: %w", err)
+	}
+	defer fd.Close()
+
+	tw := tar.NewWriter(fd)
+	if err = writeDirectoryEntries(tw, dir); err != nil {
+		return fmt.Errorf("error while writing tarball: %w", err)
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("error while writing tarball: %w", err)
+	}
+
+	return fd.Close()
+}
+
+// Writes the contents of dir, owned by root and without a leading directory
+func writeDirectoryEntries(tw *tar.Writer, dir string) error {
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || filePath == dir {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+		return err
+	})
+}
@@ -0,0 +1,150 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRootfsBuilder(t *testing.T) *Builder {
+	config, err := parseConfiguration(getCwd() + "/resources/testdata/valid_config.json")
+	if err != nil {
+		t.Fatalf("expected no parsing error, got: %s", err)
+	}
+
+	rootfs := t.TempDir()
+	if err = os.MkdirAll(rootfs+"/etc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(rootfs+"/etc/hostname", []byte("rootfsbuilder\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := NewBuilder(config, "amd64", t.TempDir(), os.Stdout, os.Stderr)
+	builder.rootfs = rootfs
+	builder.buildTime = time.Now()
+
+	return builder
+}
+
+// Reads a blob and verifies its digest and size
+func readBlob(t *testing.T, layoutDir string, descriptor ociDescriptor) []byte {
+	data, err := os.ReadFile(filepath.Join(layoutDir, blobPath(descriptor)))
+	if err != nil {
+		t.Fatalf("expected blob '%s' to exist, got: %s", descriptor.Digest, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if "sha256:"+hex.EncodeToString(sum[:]) != descriptor.Digest {
+		t.Errorf("digest mismatch for blob '%s'", descriptor.Digest)
+	}
+	if int64(len(data)) != descriptor.Size {
+		t.Errorf("size mismatch for blob '%s'", descriptor.Digest)
+	}
+
+	return data
+}
+
+func TestBuildOCIImage(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	output := &OutputV1{
+		Type:  OutputTypeOCI,
+		Image: ImageConfigV1{Env: []string{"LANG=C.UTF-8"}, Entrypoint: []string{"/bin/bash"}, Labels: map[string]string{"vendor": "test"}},
+	}
+
+	layoutDir := builder.artifactPath("oci")
+	if err := builder.buildOCIImage(output, layoutDir); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(layoutDir, "oci-layout")); err != nil {
+		t.Errorf("expected oci-layout to exist")
+	}
+
+	data, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		t.Fatalf("expected index.json to exist, got: %s", err)
+	}
+
+	index := ociIndex{}
+	if err = json.Unmarshal(data, &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("expected index with one manifest, got: %s", data)
+	}
+	if index.Manifests[0].Annotations["org.opencontainers.image.ref.name"] != "bookworm" {
+		t.Errorf("expected image to be tagged with the release")
+	}
+
+	manifest := ociManifest{}
+	if err = json.Unmarshal(readBlob(t, layoutDir, index.Manifests[0]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("expected one layer, got: %d", len(manifest.Layers))
+	}
+	readBlob(t, layoutDir, manifest.Layers[0])
+
+	image := ociImage{}
+	if err = json.Unmarshal(readBlob(t, layoutDir, manifest.Config), &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Architecture != "arm64" || image.Variant != "v8" || image.OS != "linux" {
+		t.Errorf("unexpected platform: %s/%s/%s", image.OS, image.Architecture, image.Variant)
+	}
+	if len(image.Config.Env) != 2 || image.Config.Env[0] != DefaultPathEnv {
+		t.Errorf("expected default PATH to be added, got: %v", image.Config.Env)
+	}
+	if image.Config.Labels["vendor"] != "test" {
+		t.Errorf("expected labels to be set")
+	}
+	if len(image.RootFS.DiffIDs) != 1 {
+		t.Errorf("expected one diff ID")
+	}
+}
+
+func TestBuildOCIImageTag(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	output := &OutputV1{Type: OutputTypeOCI, Format: OutputFormatDir, Tag: "registry.example.com/rootfs:v1"}
+
+	layoutDir := builder.artifactPath("oci")
+	if err := builder.buildOCIImage(output, layoutDir); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		t.Fatalf("expected index.json to exist, got: %s", err)
+	}
+
+	index := ociIndex{}
+	if err = json.Unmarshal(data, &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("expected index with one manifest, got: %s", data)
+	}
+	if name := index.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; name != "v1" {
+		t.Errorf("expected image to be tagged with the configured tag, got: '%s'", name)
+	}
+}
+
+func TestCheckOCIOutput(t *testing.T) {
+	if err := checkOCIOutput(&OutputV1{Type: OutputTypeOCI, Format: OutputFormatTar}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err := checkOCIOutput(&OutputV1{Type: OutputTypeOCI, Format: "zip"}); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+	if err := checkOCIOutput(&OutputV1{Type: OutputTypeOCI, Image: ImageConfigV1{Env: []string{"NOVALUE"}}}); err == nil {
+		t.Error("expected error for malformed environment variable")
+	}
+	if err := checkOCIOutput(&OutputV1{Type: OutputTypeOCI, Tag: "Rootfs:bookworm"}); err == nil {
+		t.Error("expected error for malformed tag")
+	}
+}
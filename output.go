@@ -0,0 +1,259 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	validOutputName = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+)
+
+// The artifacts created for one output of a build
+type BuildResult struct {
+	// The output type (e.g. "tar", "disk")
+	Type string
+	// The output name, if any
+	Name string
+	// Files or directories created for the output
+	Paths []string
+	// The built release as configured, and its codename if resolved by the
+	// preflight (e.g. stable and bookworm)
+	Release  string
+	Codename string
+}
+
+// Checks the exclude patterns of an output. Patterns are absolute paths in
+// the rootfs and may contain shell wildcards.
+func checkExcludes(excludes []string) error {
+	for _, pattern := range excludes {
+		if !path.IsAbs(pattern) {
+			return fmt.Errorf("exclude pattern '%s' is not absolute", pattern)
+		}
+		if path.Clean(pattern) == "/" {
+			return fmt.Errorf("exclude pattern '%s' matches the whole rootfs", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("malformed exclude pattern '%s'", pattern)
+		}
+	}
+
+	return nil
+}
+
+func checkTarOutput(output *OutputV1) error {
+	return checkCompression(output.Compression)
+}
+
+func checkExt4Output(output *OutputV1) error {
+	size, err := parseSize(output.Size)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return fmt.Errorf("size is required")
+	}
+
+	// ext4 volume labels are limited to 16 bytes
+	if len(output.Label) > 16 {
+		return fmt.Errorf("ext4 volume label '%s' exceeds 16 characters", output.Label)
+	}
+
+	if output.Source != "" && !path.IsAbs(output.Source) {
+		return fmt.Errorf("source '%s' is not absolute", output.Source)
+	}
+
+	return nil
+}
+
+func checkSquashfsOutput(output *OutputV1) error {
+	if output.Source != "" && !path.IsAbs(output.Source) {
+		return fmt.Errorf("source '%s' is not absolute", output.Source)
+	}
+
+	return nil
+}
+
+// Creates a hardlinked copy of the rootfs without the excluded paths
+func (b *Builder) stageExcludes(excludes []string, stageDir string) error {
+	if err := b.copyTree(b.rootfs, stageDir, true); err != nil {
+		return err
+	}
+
+	for _, pattern := range excludes {
+		matches, err := filepath.Glob(filepath.Join(stageDir, pattern))
+		if err != nil {
+			return fmt.Errorf("malformed exclude pattern '%s'", pattern)
+		}
+
+		for _, match := range matches {
+			if err = os.RemoveAll(match); err != nil {
+				return fmt.Errorf("error while excluding '%s': %w", match, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) buildOutputs() ([]BuildResult, error) {
+	results := make([]BuildResult, 0, len(b.config.Outputs))
+
+	for i := range b.config.Outputs {
+		if err := b.checkInterrupted(); err != nil {
+			return results, err
+		}
+
+		result, err := b.buildOutput(&b.config.Outputs[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, *result)
+	}
+
+	return results, nil
+}
+
+// Builds a single output. Outputs with exclude patterns are built from a
+// staged copy of the rootfs, except for tarballs which skip the excluded
+// paths while writing.
+func (b *Builder) buildOutput(output *OutputV1) (*BuildResult, error) {
+	if len(output.Exclude) > 0 && output.Type != OutputTypeTar {
+		stageDir, removeStageDir, err := b.makeTempDir(os.TempDir(), "rootfsbuilder-")
+		if err != nil {
+			return nil, err
+		}
+		defer removeStageDir()
+
+		fmt.Fprintf(b.loggerErr, "Staging rootfs without excluded paths\n")
+		rootfs := stageDir + "/rootfs"
+		if err = b.stageExcludes(output.Exclude, rootfs); err != nil {
+			return nil, fmt.Errorf("error while staging rootfs: %w", err)
+		}
+
+		// The output is built from the staged copy
+		originalRootfs := b.rootfs
+		b.rootfs = rootfs
+		defer func() { b.rootfs = originalRootfs }()
+	}
+
+	b.outputName = output.Name
+	defer func() { b.outputName = "" }()
+
+	result := &BuildResult{Type: output.Type, Name: output.Name}
+
+	switch output.Type {
+	case OutputTypeTar:
+		archivePath := b.artifactPath("tar" + CompressionExtensions[output.Compression])
+		fmt.Fprintf(b.loggerErr, "Building tarball '%s'\n", archivePath)
+		if err := b.writeTarball(archivePath, output.Compression, output.Exclude); err != nil {
+			return nil, fmt.Errorf("error while building tarball: %w", err)
+		}
+		result.Paths = []string{archivePath}
+	case OutputTypeExt4:
+		imagePath := b.artifactPath("ext4")
+		fmt.Fprintf(b.loggerErr, "Building ext4 image '%s'\n", imagePath)
+		if err := b.buildExt4Image(output, imagePath); err != nil {
+			return nil, fmt.Errorf("error while building ext4 image: %w", err)
+		}
+		result.Paths = []string{imagePath}
+	case OutputTypeSquashfs:
+		imagePath := b.artifactPath("squashfs")
+		fmt.Fprintf(b.loggerErr, "Building squashfs image '%s'\n", imagePath)
+		if err := b.makeSquashfs(path.Join(b.rootfs, output.Source), imagePath); err != nil {
+			return nil, fmt.Errorf("error while building squashfs image: %w", err)
+		}
+		result.Paths = []string{imagePath}
+	case OutputTypeDirectory:
+		fmt.Fprintf(b.loggerErr, "Placing rootfs in '%s'\n", output.Target)
+		if err := b.buildDirectory(output); err != nil {
+			return nil, fmt.Errorf("error while placing rootfs in directory: %w", err)
+		}
+		result.Paths = []string{path.Clean(output.Target)}
+	case OutputTypeDisk:
+		imagePath := b.artifactPath("img")
+		fmt.Fprintf(b.loggerErr, "Building disk image '%s'\n", imagePath)
+		if err := b.buildDiskImage(output, imagePath); err != nil {
+			return nil, fmt.Errorf("error while building disk image: %w", err)
+		}
+		result.Paths = []string{imagePath}
+
+		for j := range output.Convert {
+			convertedPath, err := b.convertImage(imagePath, &output.Convert[j])
+			if err != nil {
+				return nil, fmt.Errorf("error while converting disk image: %w", err)
+			}
+			fmt.Fprintf(b.loggerErr, "Successfully converted disk image: %s\n", convertedPath)
+			result.Paths = append(result.Paths, convertedPath)
+		}
+	case OutputTypeFat:
+		imagePath := b.artifactPath("fat.img")
+		fmt.Fprintf(b.loggerErr, "Building FAT image '%s'\n", imagePath)
+		if err := b.buildFatImage(output, imagePath); err != nil {
+			return nil, fmt.Errorf("error while building FAT image: %w", err)
+		}
+		result.Paths = []string{imagePath}
+	case OutputTypeOCI:
+		imagePath := b.artifactPath("oci")
+		if output.Format == OutputFormatTar {
+			imagePath = b.artifactPath("oci.tar")
+		}
+		fmt.Fprintf(b.loggerErr, "Building OCI image '%s'\n", imagePath)
+		if err := b.buildOCIImage(output, imagePath); err != nil {
+			return nil, fmt.Errorf("error while building OCI image: %w", err)
+		}
+		result.Paths = []string{imagePath}
+	case OutputTypeDocker:
+		archivePath := b.artifactPath("docker.tar")
+		fmt.Fprintf(b.loggerErr, "Building docker archive '%s'\n", archivePath)
+		if err := b.buildDockerArchive(output, archivePath); err != nil {
+			return nil, fmt.Errorf("error while building docker archive: %w", err)
+		}
+		result.Paths = []string{archivePath}
+	case OutputTypeBundle:
+		bundlePath := b.artifactPath("bundle")
+		fmt.Fprintf(b.loggerErr, "Building OCI runtime bundle '%s'\n", bundlePath)
+		if err := b.buildRuntimeBundle(output, bundlePath); err != nil {
+			return nil, fmt.Errorf("error while building OCI runtime bundle: %w", err)
+		}
+		result.Paths = []string{bundlePath}
+	case OutputTypeLXC:
+		fmt.Fprintf(b.loggerErr, "Building LXC image\n")
+		imagePaths, err := b.buildLXCImage(output)
+		if err != nil {
+			return nil, fmt.Errorf("error while building LXC image: %w", err)
+		}
+		result.Paths = imagePaths
+	case OutputTypeCpio:
+		archivePath := b.artifactPath("cpio" + CompressionExtensions[output.Compression])
+		fmt.Fprintf(b.loggerErr, "Building cpio archive '%s'\n", archivePath)
+		if err := b.buildCpioArchive(output, archivePath); err != nil {
+			return nil, fmt.Errorf("error while building cpio archive: %w", err)
+		}
+		result.Paths = []string{archivePath}
+	default:
+		return nil, fmt.Errorf("unsupported output type: %s", output.Type)
+	}
+
+	fmt.Fprintf(b.loggerErr, "Successfully built %s output: %s\n", output.Type, strings.Join(result.Paths, ", "))
+	return result, nil
+}
+
+func (b *Builder) buildExt4Image(output *OutputV1, imagePath string) error {
+	size, err := parseSize(output.Size)
+	if err != nil {
+		return err
+	}
+
+	return b.makeExtFilesystem(FilesystemExt4, path.Join(b.rootfs, output.Source), imagePath, size, output.Label)
+}
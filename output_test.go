@@ -0,0 +1,166 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCheckExcludes(t *testing.T) {
+	if err := checkExcludes([]string{"/usr/share/doc/*", "/var/cache/apt"}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if err := checkExcludes([]string{"usr/share/doc"}); err == nil {
+		t.Error("expected error for relative exclude pattern")
+	}
+
+	if err := checkExcludes([]string{"/./"}); err == nil {
+		t.Error("expected error for excluding the whole rootfs")
+	}
+
+	if err := checkExcludes([]string{"/usr/[a"}); err == nil {
+		t.Error("expected error for malformed exclude pattern")
+	}
+}
+
+func TestCheckExt4Output(t *testing.T) {
+	if err := checkExt4Output(&OutputV1{Type: OutputTypeExt4, Size: "1G", Label: "rootfs"}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if err := checkExt4Output(&OutputV1{Type: OutputTypeExt4}); err == nil {
+		t.Error("expected error for missing size")
+	}
+
+	if err := checkExt4Output(&OutputV1{Type: OutputTypeExt4, Size: "1G", Label: "a-very-long-ext4-label"}); err == nil {
+		t.Error("expected error for long label")
+	}
+}
+
+func TestCheckDuplicateOutputs(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	config := builder.config
+
+	config.Outputs = []OutputV1{
+		{Type: OutputTypeSquashfs},
+		{Type: OutputTypeSquashfs, Name: "netboot"},
+	}
+	if err := checkRequiredFields(config); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	config.Outputs = append(config.Outputs, OutputV1{Type: OutputTypeSquashfs})
+	if err := checkRequiredFields(config); err == nil {
+		t.Error("expected error for duplicate output")
+	}
+
+	// Clashes with the legacy tarball
+	config.Outputs = []OutputV1{{Type: OutputTypeTar, Compression: CompressionGzip}}
+	if err := checkRequiredFields(config); err == nil {
+		t.Error("expected error for unnamed tar output next to the tarball type")
+	}
+
+	config.TarballType = ""
+	if err := checkRequiredFields(config); err != nil {
+		t.Errorf("expected no error without tarball type, got: %s", err)
+	}
+
+	config.Outputs = nil
+	if err := checkRequiredFields(config); err == nil {
+		t.Error("expected error without tarball type and outputs")
+	}
+
+	config.Outputs = []OutputV1{{Type: OutputTypeTar, Name: "../rootfs"}}
+	if err := checkRequiredFields(config); err == nil {
+		t.Error("expected error for malformed output name")
+	}
+}
+
+func TestArtifactPathWithName(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	builder.outputName = "netboot"
+	if !strings.HasSuffix(builder.artifactPath("squashfs"), "-netboot.squashfs") {
+		t.Errorf("expected output name in artifact path, got: %s", builder.artifactPath("squashfs"))
+	}
+}
+
+func TestBuildOutputWithExcludes(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	rootfs := builder.rootfs
+
+	if err := os.MkdirAll(rootfs+"/usr/share/doc/bash", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rootfs+"/usr/share/doc/bash/copyright", []byte("GPL"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &OutputV1{
+		Type:        OutputTypeTar,
+		Name:        "slim",
+		Compression: CompressionGzip,
+		Exclude:     []string{"/usr/share/doc/*"},
+	}
+
+	result, err := builder.buildOutput(output)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	if result.Type != OutputTypeTar || result.Name != "slim" || len(result.Paths) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if !strings.HasSuffix(result.Paths[0], "-slim.tar.gz") {
+		t.Errorf("expected gzip tarball, got: %s", result.Paths[0])
+	}
+
+	if builder.rootfs != rootfs || builder.outputName != "" {
+		t.Error("expected builder state to be restored")
+	}
+
+	// The rootfs itself is left untouched
+	if _, err = os.Stat(rootfs + "/usr/share/doc/bash/copyright"); err != nil {
+		t.Errorf("expected excluded file to remain in rootfs, got: %s", err)
+	}
+
+	fd, err := os.Open(result.Paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatalf("expected gzip stream, got: %s", err)
+	}
+
+	names := []string{}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+
+	expected := []string{"./", "./etc/", "./etc/hostname", "./usr/", "./usr/share/", "./usr/share/doc/"}
+	if strings.Join(names, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected members %v, got %v", expected, names)
+	}
+}
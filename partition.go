@@ -0,0 +1,317 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	SectorSize = 512
+	// Partitions are aligned to 1 MiB boundaries
+	PartitionAlignment = 1024 * 1024
+
+	gptEntryCount = 128
+	gptEntrySize  = 128
+	gptHeaderSize = 92
+	// Sectors occupied by the partition entry array
+	gptEntrySectors = gptEntryCount * gptEntrySize / SectorSize
+)
+
+var (
+	// Well-known GPT partition type GUIDs
+	// https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+	GPTTypeAliases = map[string]string{
+		"linux":            "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+		"esp":              "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+		"xbootldr":         "BC13C2FF-59E6-4262-A352-B275FD6F7172",
+		"swap":             "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F",
+		"home":             "933AC7E1-2EB4-4F13-B844-0E14E2AEF915",
+		"bios-boot":        "21686148-6449-6E6F-744E-656564454649",
+		"linux-root-amd64": "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709",
+		"linux-root-arm64": "B921B045-1DF0-41C3-AF44-4C6F280D3FAE",
+		"linux-root-armhf": "69DAD710-2CE4-4E3C-B16C-21A1D49ABED3",
+	}
+
+	// Well-known MBR partition type IDs
+	MBRTypeAliases = map[string]byte{
+		"linux": 0x83,
+		"swap":  0x82,
+		"fat16": 0x0e,
+		"fat32": 0x0c,
+		"esp":   0xef,
+	}
+)
+
+// A GUID in its textual representation
+// (e.g. 0FC63DAF-8483-4772-8E79-3D69D8477DE4).
+type GUID [16]byte
+
+func NewRandomGUID() (GUID, error) {
+	var g GUID
+	if _, err := io.ReadFull(rand.Reader, g[:]); err != nil {
+		return g, fmt.Errorf("error while generating random GUID: %w", err)
+	}
+
+	// Version 4, RFC 4122 variant
+	g[6] = (g[6] & 0x0f) | 0x40
+	g[8] = (g[8] & 0x3f) | 0x80
+
+	return g, nil
+}
+
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+
+	raw := strings.ReplaceAll(s, "-", "")
+	if len(raw) != 32 || strings.Count(s, "-") != 4 {
+		return g, fmt.Errorf("malformed GUID '%s'", s)
+	}
+
+	if _, err := hex.Decode(g[:], []byte(raw)); err != nil {
+		return g, fmt.Errorf("malformed GUID '%s': %w", s, err)
+	}
+
+	return g, nil
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16])
+}
+
+// The on-disk representation uses little endian for the first three fields
+func (g GUID) mixedEndian() [16]byte {
+	var out [16]byte
+	copy(out[:], g[:])
+
+	out[0], out[1], out[2], out[3] = g[3], g[2], g[1], g[0]
+	out[4], out[5] = g[5], g[4]
+	out[6], out[7] = g[7], g[6]
+
+	return out
+}
+
+// Resolves a GPT partition type alias or GUID.
+func GPTPartitionType(s string) (GUID, error) {
+	if alias, ok := GPTTypeAliases[strings.ToLower(s)]; ok {
+		s = alias
+	}
+
+	return ParseGUID(s)
+}
+
+// Resolves a MBR partition type alias or hexadecimal ID (e.g. 0x83).
+func MBRPartitionType(s string) (byte, error) {
+	if alias, ok := MBRTypeAliases[strings.ToLower(s)]; ok {
+		return alias, nil
+	}
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown MBR partition type '%s'", s)
+	}
+
+	return byte(id), nil
+}
+
+// A partition in the partition table. Offsets are in sectors.
+type PartitionEntry struct {
+	Name     string
+	StartLBA uint64
+	Sectors  uint64
+	// GPT only
+	TypeGUID GUID
+	UUID     GUID
+	// MBR only
+	TypeID   byte
+	Bootable bool
+}
+
+type PartitionTable struct {
+	// gpt or mbr
+	Type string
+	// Size of the disk in sectors
+	Sectors    uint64
+	DiskGUID   GUID
+	Signature  uint32
+	Partitions []PartitionEntry
+}
+
+// Returns the first usable sector for partition data
+func (t *PartitionTable) FirstUsableLBA() uint64 {
+	if t.Type == PartitionTableGPT {
+		return 2 + gptEntrySectors
+	}
+
+	return 1
+}
+
+// Returns the last usable sector for partition data
+func (t *PartitionTable) LastUsableLBA() uint64 {
+	if t.Type == PartitionTableGPT {
+		return t.Sectors - 2 - gptEntrySectors
+	}
+
+	return t.Sectors - 1
+}
+
+// Returns the PARTUUID as used by the kernel and blkid for the
+// partition with the given index.
+func (t *PartitionTable) PartUUID(index int) string {
+	if t.Type == PartitionTableMBR {
+		return fmt.Sprintf("%08x-%02x", t.Signature, index+1)
+	}
+
+	return t.Partitions[index].UUID.String()
+}
+
+// Writes the partition table into the (already sized) disk image.
+func (t *PartitionTable) WriteTo(w io.WriterAt) error {
+	for i, p := range t.Partitions {
+		if p.StartLBA < t.FirstUsableLBA() || p.StartLBA+p.Sectors-1 > t.LastUsableLBA() {
+			return fmt.Errorf("partition %d does not fit into the usable area of the disk", i+1)
+		}
+	}
+
+	switch t.Type {
+	case PartitionTableGPT:
+		return t.writeGPT(w)
+	case PartitionTableMBR:
+		return t.writeMBR(w)
+	}
+
+	return fmt.Errorf("unsupported partition table type '%s'", t.Type)
+}
+
+func (t *PartitionTable) writeMBR(w io.WriterAt) error {
+	if len(t.Partitions) > 4 {
+		return fmt.Errorf("a MBR partition table supports at most 4 primary partitions, got %d", len(t.Partitions))
+	}
+
+	mbr := make([]byte, SectorSize)
+	binary.LittleEndian.PutUint32(mbr[440:], t.Signature)
+
+	for i, p := range t.Partitions {
+		if p.StartLBA+p.Sectors > 0xffffffff {
+			return fmt.Errorf("partition %d exceeds the 2 TiB limit of MBR partition tables", i+1)
+		}
+
+		entry := mbr[446+i*16 : 446+(i+1)*16]
+		if p.Bootable {
+			entry[0] = 0x80
+		}
+		// CHS addressing is unused, mark as out of range
+		copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+		entry[4] = p.TypeID
+		copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(entry[8:], uint32(p.StartLBA))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(p.Sectors))
+	}
+
+	mbr[510] = 0x55
+	mbr[511] = 0xaa
+
+	_, err := w.WriteAt(mbr, 0)
+	return err
+}
+
+func (t *PartitionTable) writeGPT(w io.WriterAt) error {
+	if len(t.Partitions) > gptEntryCount {
+		return fmt.Errorf("a GPT partition table supports at most %d partitions, got %d", gptEntryCount, len(t.Partitions))
+	}
+
+	// Protective MBR spanning the whole disk
+	mbr := make([]byte, SectorSize)
+	protective := mbr[446:462]
+	copy(protective[1:4], []byte{0x00, 0x02, 0x00})
+	protective[4] = 0xee
+	copy(protective[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(protective[8:], 1)
+	size := t.Sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(protective[12:], uint32(size))
+	mbr[510] = 0x55
+	mbr[511] = 0xaa
+
+	if _, err := w.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	for i, p := range t.Partitions {
+		entry := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		typeGUID := p.TypeGUID.mixedEndian()
+		uuid := p.UUID.mixedEndian()
+		copy(entry[0:16], typeGUID[:])
+		copy(entry[16:32], uuid[:])
+		binary.LittleEndian.PutUint64(entry[32:], p.StartLBA)
+		binary.LittleEndian.PutUint64(entry[40:], p.StartLBA+p.Sectors-1)
+
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name '%s' exceeds 36 UTF-16 code units", p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+j*2:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	lastLBA := t.Sectors - 1
+	backupEntriesLBA := lastLBA - gptEntrySectors
+
+	primary := t.gptHeader(1, lastLBA, 2, entriesCRC)
+	backup := t.gptHeader(lastLBA, 1, backupEntriesLBA, entriesCRC)
+
+	if _, err := w.WriteAt(primary, SectorSize); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(entries, 2*SectorSize); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(entries, int64(backupEntriesLBA*SectorSize)); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(backup, int64(lastLBA*SectorSize)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *PartitionTable) gptHeader(currentLBA uint64, backupLBA uint64, entriesLBA uint64, entriesCRC uint32) []byte {
+	header := make([]byte, SectorSize)
+	diskGUID := t.DiskGUID.mixedEndian()
+
+	copy(header[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(header[8:], 0x00010000)
+	binary.LittleEndian.PutUint32(header[12:], gptHeaderSize)
+	binary.LittleEndian.PutUint64(header[24:], currentLBA)
+	binary.LittleEndian.PutUint64(header[32:], backupLBA)
+	binary.LittleEndian.PutUint64(header[40:], t.FirstUsableLBA())
+	binary.LittleEndian.PutUint64(header[48:], t.LastUsableLBA())
+	copy(header[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(header[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(header[80:], gptEntryCount)
+	binary.LittleEndian.PutUint32(header[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(header[88:], entriesCRC)
+
+	// The header CRC is calculated with the CRC field zeroed
+	binary.LittleEndian.PutUint32(header[16:], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+
+	return header
+}
@@ -0,0 +1,156 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+func TestParseGUID(t *testing.T) {
+	guid, err := ParseGUID("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	if err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	if guid.String() != "0fc63daf-8483-4772-8e79-3d69d8477de4" {
+		t.Errorf("expected GUID to round-trip, got: %s", guid)
+	}
+
+	encoded := guid.mixedEndian()
+	if encoded[0] != 0xaf || encoded[3] != 0x0f || encoded[4] != 0x83 || encoded[8] != 0x8e {
+		t.Errorf("unexpected mixed endian encoding: %x", encoded)
+	}
+
+	if _, err = ParseGUID("0FC63DAF84834772"); err == nil {
+		t.Error("expected error while parsing malformed GUID")
+	}
+}
+
+func TestPartitionTypeAliases(t *testing.T) {
+	if _, err := GPTPartitionType("esp"); err != nil {
+		t.Errorf("expected GPT alias 'esp' to resolve, got: %s", err)
+	}
+
+	id, err := MBRPartitionType("0x83")
+	if err != nil || id != 0x83 {
+		t.Errorf("expected MBR type 0x83, got: %x (%v)", id, err)
+	}
+
+	if _, err = MBRPartitionType("nonsense"); err == nil {
+		t.Error("expected error while resolving unknown MBR partition type")
+	}
+}
+
+func readImage(t *testing.T, table *PartitionTable) []byte {
+	fd, err := os.CreateTemp(os.TempDir(), "rootfsbuilder-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	if err = fd.Truncate(int64(table.Sectors * SectorSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = table.WriteTo(fd); err != nil {
+		t.Fatalf("expected no error while writing partition table, got: %s", err)
+	}
+
+	data, err := os.ReadFile(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestWriteGPT(t *testing.T) {
+	typeGUID, _ := GPTPartitionType("linux")
+	uuid, _ := NewRandomGUID()
+	table := &PartitionTable{
+		Type:    PartitionTableGPT,
+		Sectors: 8192,
+		Partitions: []PartitionEntry{
+			{Name: "rootfs", StartLBA: 2048, Sectors: 4096, TypeGUID: typeGUID, UUID: uuid},
+		},
+	}
+
+	data := readImage(t, table)
+
+	if data[510] != 0x55 || data[511] != 0xaa || data[446+4] != 0xee {
+		t.Error("expected a protective MBR")
+	}
+
+	for _, lba := range []uint64{1, table.Sectors - 1} {
+		header := data[lba*SectorSize : lba*SectorSize+gptHeaderSize]
+		if string(header[0:8]) != "EFI PART" {
+			t.Errorf("expected GPT signature at LBA %d", lba)
+		}
+
+		crc := binary.LittleEndian.Uint32(header[16:])
+		check := make([]byte, gptHeaderSize)
+		copy(check, header)
+		binary.LittleEndian.PutUint32(check[16:], 0)
+		if crc32.ChecksumIEEE(check) != crc {
+			t.Errorf("header CRC mismatch at LBA %d", lba)
+		}
+
+		entriesLBA := binary.LittleEndian.Uint64(header[72:])
+		entries := data[entriesLBA*SectorSize : entriesLBA*SectorSize+gptEntryCount*gptEntrySize]
+		if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:]) {
+			t.Errorf("partition entries CRC mismatch at LBA %d", entriesLBA)
+		}
+
+		if binary.LittleEndian.Uint64(entries[32:]) != 2048 || binary.LittleEndian.Uint64(entries[40:]) != 6143 {
+			t.Error("unexpected partition boundaries")
+		}
+	}
+}
+
+func TestWriteMBR(t *testing.T) {
+	table := &PartitionTable{
+		Type:      PartitionTableMBR,
+		Sectors:   8192,
+		Signature: 0xdeadbeef,
+		Partitions: []PartitionEntry{
+			{StartLBA: 2048, Sectors: 2048, TypeID: 0x0c, Bootable: true},
+			{StartLBA: 4096, Sectors: 4096, TypeID: 0x83},
+		},
+	}
+
+	data := readImage(t, table)
+
+	if binary.LittleEndian.Uint32(data[440:]) != 0xdeadbeef {
+		t.Error("expected disk signature to be written")
+	}
+	if data[446] != 0x80 || data[446+4] != 0x0c || data[462+4] != 0x83 {
+		t.Error("unexpected partition entries")
+	}
+	if binary.LittleEndian.Uint32(data[462+8:]) != 4096 || binary.LittleEndian.Uint32(data[462+12:]) != 4096 {
+		t.Error("unexpected partition boundaries")
+	}
+
+	if table.PartUUID(1) != "deadbeef-02" {
+		t.Errorf("unexpected PARTUUID: %s", table.PartUUID(1))
+	}
+}
+
+func TestWritePartitionOutOfBounds(t *testing.T) {
+	table := &PartitionTable{
+		Type:       PartitionTableGPT,
+		Sectors:    4096,
+		Partitions: []PartitionEntry{{StartLBA: 2048, Sectors: 4096}},
+	}
+
+	if err := table.WriteTo(nil); err == nil {
+		t.Error("expected error while writing partition exceeding the disk")
+	}
+}
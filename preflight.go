@@ -0,0 +1,182 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DebootstrapScriptsDir = "/usr/share/debootstrap/scripts"
+	// Timeout of fetching the Release file of a mirror
+	PreflightTimeout = 30 * time.Second
+)
+
+// Reports whether the installed debootstrap has a script for a release of
+// the distribution. The scripts of a distribution's releases are symlinks
+// to the one script that installs all of them (e.g. bookworm to sid).
+func (p *DistributionProfile) hasDebootstrapScript(release string, scriptsDir string) bool {
+	if p.DebootstrapScript == "" || strings.Contains(release, "/") {
+		return false
+	}
+
+	target, err := filepath.EvalSymlinks(filepath.Join(scriptsDir, release))
+	if err != nil {
+		return false
+	}
+
+	return filepath.Base(target) == p.DebootstrapScript
+}
+
+// Checks that the installed debootstrap has a script for the release, also
+// for releases known to the profile. Nothing is checked if debootstrap is
+// not installed, which fails the build anyway.
+func (p *DistributionProfile) checkDebootstrapScript(distribution string, release string, scriptsDir string) error {
+	if _, err := os.Stat(scriptsDir); os.IsNotExist(err) {
+		return nil
+	}
+	if !p.hasDebootstrapScript(release, scriptsDir) {
+		return fmt.Errorf("release '%s' of %s is unknown to the installed debootstrap, no script in '%s'", release, distribution, scriptsDir)
+	}
+
+	return nil
+}
+
+// The fields of a Release file checked by the preflight
+type releaseFile struct {
+	Suite         string
+	Codename      string
+	Architectures []string
+	Components    []string
+}
+
+// Parses the fields of a Release file (or InRelease file without its
+// signature) up to the file lists
+func parseReleaseFile(r io.Reader) (*releaseFile, error) {
+	release := &releaseFile{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Continuation lines belong to the file lists
+		if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(fields[1])
+
+		switch fields[0] {
+		case "Suite":
+			release.Suite = value
+		case "Codename":
+			release.Codename = value
+		case "Architectures":
+			release.Architectures = strings.Fields(value)
+		case "Components":
+			release.Components = strings.Fields(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if release.Codename == "" && release.Suite == "" {
+		return nil, fmt.Errorf("not a Release file, neither suite nor codename found")
+	}
+
+	return release, nil
+}
+
+// Checks that the release is available for the architecture and
+// components
+func (r *releaseFile) check(arch string, components []string) error {
+	if !containsString(r.Architectures, arch) {
+		return fmt.Errorf("architecture '%s' is not available, available: %s", arch, strings.Join(r.Architectures, ", "))
+	}
+
+	for _, component := range components {
+		found := false
+		for _, available := range r.Components {
+			// Security archives list e.g. "updates/main"
+			if available == component || strings.HasSuffix(available, "/"+component) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("component '%s' is not available, available: %s", component, strings.Join(r.Components, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Fetches dists/<release>/Release from a mirror. Mirrors may be HTTP(S) or
+// file URLs.
+func fetchReleaseFile(mirror string, release string) (*releaseFile, error) {
+	url := strings.TrimSuffix(mirror, "/") + "/dists/" + release + "/Release"
+
+	var body io.ReadCloser
+	if strings.HasPrefix(url, "file://") {
+		fd, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		body = fd
+	} else {
+		client := &http.Client{Timeout: PreflightTimeout}
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("'%s': %s", url, resp.Status)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	parsed, err := parseReleaseFile(body)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %w", url, err)
+	}
+
+	return parsed, nil
+}
+
+// Checks the release on the mirror before anything is built, and resolves
+// aliases (e.g. stable) to the codename of the release
+func (b *Builder) preflight() error {
+	fmt.Fprintf(b.loggerErr, "Checking release '%s' on mirror '%s'\n", b.config.Release, b.config.Mirror)
+
+	release, err := fetchReleaseFile(b.config.Mirror, b.config.Release)
+	if err != nil {
+		return fmt.Errorf("error while fetching release file: %w", err)
+	}
+	if err = release.check(b.config.Architecture, b.config.Components); err != nil {
+		return fmt.Errorf("release '%s' on mirror '%s': %w", b.config.Release, b.config.Mirror, err)
+	}
+
+	b.codename = release.Codename
+	if b.codename != "" && b.codename != b.config.Release {
+		fmt.Fprintf(b.loggerErr, "Release '%s' is '%s'\n", b.config.Release, b.codename)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testReleaseFile = `Origin: Debian
+Label: Debian
+Suite: stable
+Version: 12.5
+Codename: bookworm
+Date: Sat, 10 Feb 2024 10:45:48 UTC
+Acquire-By-Hash: yes
+Architectures: all amd64 arm64 armel armhf i386 mips64el mipsel ppc64el s390x
+Components: main contrib non-free-firmware non-free
+Description: Debian 12.5 Released 10 February 2024
+MD5Sum:
+ 0ed6d4c8891eb86358b94bb35d9e4da4  1484322 contrib/Contents-all
+ d0a0325a97c42fd5f66a8c3e29bcea64    98581 contrib/Contents-all.gz
+`
+
+func TestHasDebootstrapScript(t *testing.T) {
+	scriptsDir := t.TempDir()
+	for _, script := range []string{"sid", "gutsy"} {
+		if err := os.WriteFile(scriptsDir+"/"+script, []byte("mirror_style release\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"duke": "sid", "resolute": "gutsy"} {
+		if err := os.Symlink(target, scriptsDir+"/"+link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	debian := DistributionProfiles[DistributionDebian]
+	ubuntu := DistributionProfiles[DistributionUbuntu]
+	if !debian.hasDebootstrapScript("duke", scriptsDir) || !ubuntu.hasDebootstrapScript("resolute", scriptsDir) {
+		t.Error("expected scripts of new releases to be found")
+	}
+	if ubuntu.hasDebootstrapScript("duke", scriptsDir) || debian.hasDebootstrapScript("bookwrom", scriptsDir) {
+		t.Error("expected scripts of other distributions and misspelled releases to be rejected")
+	}
+	if debian.hasDebootstrapScript("../sid", scriptsDir) {
+		t.Error("expected releases with slashes to be rejected")
+	}
+
+	// Releases newer than the profile are accepted if debootstrap knows them
+	if err := debian.check(DistributionDebian, "duke", "amd64", scriptsDir); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err := debian.check(DistributionDebian, "bookwrom", "amd64", scriptsDir); err == nil {
+		t.Error("expected error for misspelled release")
+	}
+
+	// Known to the profile, but not to the installed debootstrap
+	if err := debian.checkDebootstrapScript(DistributionDebian, "forky", scriptsDir); err == nil {
+		t.Error("expected error for release without script")
+	}
+	if err := debian.checkDebootstrapScript(DistributionDebian, "duke", scriptsDir); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	// debootstrap is not installed
+	if err := debian.checkDebootstrapScript(DistributionDebian, "forky", scriptsDir+"/missing"); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
+
+func TestParseReleaseFile(t *testing.T) {
+	release, err := parseReleaseFile(strings.NewReader(testReleaseFile))
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if release.Suite != "stable" || release.Codename != "bookworm" || len(release.Architectures) != 10 || len(release.Components) != 4 {
+		t.Errorf("unexpected release: %+v", release)
+	}
+
+	if err = release.check("arm64", []string{"main", "non-free-firmware"}); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err = release.check("riscv64", []string{"main"}); err == nil {
+		t.Error("expected error for unavailable architecture")
+	}
+	if err = release.check("amd64", []string{"universe"}); err == nil {
+		t.Error("expected error for unavailable component")
+	}
+
+	security := &releaseFile{Codename: "bookworm-security", Architectures: []string{"amd64"}, Components: []string{"updates/main"}}
+	if err = security.check("amd64", []string{"main"}); err != nil {
+		t.Errorf("expected component of security archive to match, got: %s", err)
+	}
+
+	if _, err = parseReleaseFile(strings.NewReader("<html></html>\n")); err == nil {
+		t.Error("expected error for invalid Release file")
+	}
+}
+
+func TestFetchReleaseFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debian/dists/stable/Release" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testReleaseFile))
+	}))
+	defer server.Close()
+
+	release, err := fetchReleaseFile(server.URL+"/debian/", "stable")
+	if err != nil || release.Codename != "bookworm" {
+		t.Errorf("expected release to be fetched, got: %+v, %v", release, err)
+	}
+	if _, err = fetchReleaseFile(server.URL+"/debian", "bookwrom"); err == nil {
+		t.Error("expected error for missing release")
+	}
+
+	mirror := t.TempDir()
+	if err = os.MkdirAll(mirror+"/dists/bookworm", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(mirror+"/dists/bookworm/Release", []byte(testReleaseFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if release, err = fetchReleaseFile("file://"+mirror, "bookworm"); err != nil || release.Suite != "stable" {
+		t.Errorf("expected local release to be read, got: %+v, %v", release, err)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	mirror := t.TempDir()
+	if err := os.MkdirAll(mirror+"/dists/stable", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mirror+"/dists/stable/Release", []byte(testReleaseFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	builder := newTestRootfsBuilder(t)
+	builder.loggerErr = &log
+	builder.config.Release = "stable"
+	builder.config.Mirror = "file://" + mirror
+	builder.config.Components = []string{"main"}
+
+	if err := builder.preflight(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if description := builder.releaseDescription(); description != "debian stable (bookworm) arm64" {
+		t.Errorf("expected codename in build report, got: %s", description)
+	}
+	results := builder.recordRelease([]BuildResult{{Type: OutputTypeTar}})
+	if results[0].Release != "stable" || results[0].Codename != "bookworm" {
+		t.Errorf("expected release in build result, got: %+v", results[0])
+	}
+	if !strings.Contains(log.String(), "Release 'stable' is 'bookworm'") {
+		t.Errorf("expected resolved codename to be logged, got: %q", log.String())
+	}
+
+	builder.config.Components = []string{"main", "universe"}
+	if err := builder.preflight(); err == nil {
+		t.Error("expected error for unavailable component")
+	}
+}
+
+func TestCheckPreflight(t *testing.T) {
+	config := newTestRootfsBuilder(t).config
+	config.Preflight = true
+	if err := checkRequiredFields(config); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+
+	config.Distribution = DistributionAlpine
+	config.Release = "v3.19"
+	config.Variant = ""
+	if err := checkRequiredFields(config); err == nil || !strings.Contains(err.Error(), "preflight") {
+		t.Errorf("expected error for preflight of Alpine Linux, got: %v", err)
+	}
+}
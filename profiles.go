@@ -0,0 +1,234 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Defaults and constraints of a distribution
+type DistributionProfile struct {
+	// Used if no bootstrapper is configured
+	Bootstrapper string
+	// Default mirror per architecture. The empty key applies to all other
+	// architectures.
+	Mirrors map[string]string
+	// Used if no components are configured
+	Components []string
+	// Keyring (or directory of keys) the mirror is verified with, used if
+	// present on the host
+	Keyring string
+	// Releases that can be built. Any release if empty.
+	Suites []string
+	// Architectures that can be built. Any architecture if empty.
+	Architectures []string
+	// The debootstrap script that installs all releases (e.g. "sid")
+	DebootstrapScript string
+	// Suites shipped with final_sources in addition to a release, named
+	// after it (e.g. "%s-updates"). None if empty.
+	UpdatesSuite  string
+	SecuritySuite string
+	// Security suites that are not named like SecuritySuite
+	SecuritySuites map[string]string
+	// Mirror of the security suite per architecture, like Mirrors. Default:
+	// the mirror of the release.
+	SecurityMirrors map[string]string
+	// Releases without updates and security suites
+	RollingSuites []string
+}
+
+var DistributionProfiles = map[string]*DistributionProfile{
+	DistributionDebian: {
+		Bootstrapper: BootstrapperDebootstrap,
+		Mirrors:      map[string]string{"": "http://deb.debian.org/debian"},
+		Components:   []string{"main"},
+		Keyring:      "/usr/share/keyrings/debian-archive-keyring.gpg",
+		Suites: []string{
+			"buster", "bullseye", "bookworm", "trixie", "forky", "sid",
+			"oldoldstable", "oldstable", "stable", "testing", "unstable",
+		},
+		Architectures:     []string{"amd64", "i386", "arm64", "armel", "armhf", "mips64el", "mipsel", "ppc64el", "s390x"},
+		DebootstrapScript: "sid",
+		UpdatesSuite:      "%s-updates",
+		SecuritySuite:     "%s-security",
+		SecuritySuites:    map[string]string{"buster": "buster/updates"},
+		SecurityMirrors:   map[string]string{"": "http://security.debian.org/debian-security"},
+		RollingSuites:     []string{"sid", "unstable"},
+	},
+	DistributionUbuntu: {
+		Bootstrapper: BootstrapperDebootstrap,
+		// Other architectures are served by the ports archive
+		Mirrors: map[string]string{
+			"amd64": "http://archive.ubuntu.com/ubuntu",
+			"i386":  "http://archive.ubuntu.com/ubuntu",
+			"":      "http://ports.ubuntu.com/ubuntu-ports",
+		},
+		Components:        []string{"main", "universe"},
+		Keyring:           "/usr/share/keyrings/ubuntu-archive-keyring.gpg",
+		Suites:            []string{"bionic", "focal", "jammy", "noble", "oracular", "plucky", "questing"},
+		Architectures:     []string{"amd64", "i386", "arm64", "armhf", "ppc64el", "s390x"},
+		DebootstrapScript: "gutsy",
+		UpdatesSuite:      "%s-updates",
+		SecuritySuite:     "%s-security",
+		SecurityMirrors: map[string]string{
+			"amd64": "http://security.ubuntu.com/ubuntu",
+			"i386":  "http://security.ubuntu.com/ubuntu",
+			"":      "http://ports.ubuntu.com/ubuntu-ports",
+		},
+	},
+	DistributionDevuan: {
+		Bootstrapper: BootstrapperDebootstrap,
+		Mirrors:      map[string]string{"": "http://deb.devuan.org/merged"},
+		Components:   []string{"main"},
+		Keyring:      "/usr/share/keyrings/devuan-archive-keyring.gpg",
+		Suites: []string{
+			"beowulf", "chimaera", "daedalus", "excalibur", "ceres",
+			"oldstable", "stable", "testing", "unstable",
+		},
+		Architectures:     []string{"amd64", "i386", "arm64", "armel", "armhf", "ppc64el"},
+		DebootstrapScript: "ceres",
+		UpdatesSuite:      "%s-updates",
+		SecuritySuite:     "%s-security",
+		RollingSuites:     []string{"ceres", "unstable"},
+	},
+	DistributionKali: {
+		Bootstrapper:      BootstrapperDebootstrap,
+		Mirrors:           map[string]string{"": "http://http.kali.org/kali"},
+		Components:        []string{"main", "contrib", "non-free", "non-free-firmware"},
+		Keyring:           "/usr/share/keyrings/kali-archive-keyring.gpg",
+		Suites:            []string{"kali-rolling", "kali-last-snapshot", "kali-dev"},
+		Architectures:     []string{"amd64", "i386", "arm64", "armel", "armhf"},
+		DebootstrapScript: "kali",
+	},
+	DistributionRaspbian: {
+		Bootstrapper:      BootstrapperDebootstrap,
+		Mirrors:           map[string]string{"": "http://raspbian.raspberrypi.com/raspbian"},
+		Components:        []string{"main", "contrib", "non-free", "rpi"},
+		Keyring:           "/usr/share/keyrings/raspbian-archive-keyring.gpg",
+		Suites:            []string{"buster", "bullseye", "bookworm", "trixie", "oldstable", "stable", "testing"},
+		Architectures:     []string{"armhf"},
+		DebootstrapScript: "sid",
+	},
+	DistributionAlpine: {
+		Bootstrapper:  BootstrapperApk,
+		Mirrors:       map[string]string{"": "https://dl-cdn.alpinelinux.org/alpine"},
+		Components:    []string{AlpineDefaultComponent},
+		Keyring:       ApkKeysDir,
+		Architectures: []string{"amd64", "i386", "arm64", "armhf", "ppc64el", "s390x"},
+	},
+	DistributionFedora: {
+		Bootstrapper:  BootstrapperDnf,
+		Mirrors:       map[string]string{"": "https://dl.fedoraproject.org/pub/fedora/linux/releases/$releasever/Everything/$basearch/os/"},
+		Architectures: []string{"amd64", "arm64", "ppc64el", "s390x"},
+	},
+	DistributionRocky: {
+		Bootstrapper:  BootstrapperDnf,
+		Mirrors:       map[string]string{"": "https://dl.rockylinux.org/pub/rocky/$releasever/BaseOS/$basearch/os/"},
+		Architectures: []string{"amd64", "arm64", "ppc64el", "s390x"},
+	},
+}
+
+func lookupProfile(distribution string) (*DistributionProfile, error) {
+	profile, ok := DistributionProfiles[distribution]
+	if !ok {
+		names := []string{}
+		for name := range DistributionProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unsupported distribution '%s', supported: %s", distribution, strings.Join(names, ", "))
+	}
+
+	return profile, nil
+}
+
+func mirrorForArch(mirrors map[string]string, arch string) string {
+	if mirror, ok := mirrors[arch]; ok {
+		return mirror
+	}
+
+	return mirrors[""]
+}
+
+func (p *DistributionProfile) defaultMirror(arch string) string {
+	return mirrorForArch(p.Mirrors, arch)
+}
+
+func (p *DistributionProfile) securityMirror(arch string) string {
+	if mirror := mirrorForArch(p.SecurityMirrors, arch); mirror != "" {
+		return mirror
+	}
+
+	return p.defaultMirror(arch)
+}
+
+// Returns the keyrings of the profile that are present on the host
+func (p *DistributionProfile) keyrings() []string {
+	if p.Keyring == "" {
+		return nil
+	}
+	if _, err := os.Stat(p.Keyring); err != nil {
+		return nil
+	}
+
+	return []string{p.Keyring}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks that the release and architecture exist for the distribution.
+// Releases newer than the profile are known by the installed debootstrap.
+func (p *DistributionProfile) check(distribution string, release string, arch string, scriptsDir string) error {
+	if len(p.Suites) > 0 && !containsString(p.Suites, release) && !p.hasDebootstrapScript(release, scriptsDir) {
+		return fmt.Errorf("unknown release '%s' of %s (no debootstrap script in '%s'), known: %s", release, distribution, scriptsDir, strings.Join(p.Suites, ", "))
+	}
+	if len(p.Architectures) > 0 && !containsString(p.Architectures, arch) {
+		return fmt.Errorf("architecture '%s' is not available for %s, available: %s", arch, distribution, strings.Join(p.Architectures, ", "))
+	}
+
+	return nil
+}
+
+// Fills in the mirror and components of the distribution, and of the final
+// sources, if not configured. Unknown distributions are left to
+// checkRequiredFields.
+func applyDistributionProfile(config *ConfigurationV1) {
+	profile, ok := DistributionProfiles[config.Distribution]
+	if !ok {
+		return
+	}
+
+	if config.Mirror == "" {
+		config.Mirror = profile.defaultMirror(config.Architecture)
+	}
+	if len(config.Components) == 0 {
+		config.Components = profile.Components
+	}
+
+	if sources := config.FinalSources; sources != nil {
+		if sources.Mirror == "" {
+			sources.Mirror = profile.defaultMirror(config.Architecture)
+		}
+		if sources.SecurityMirror == "" {
+			sources.SecurityMirror = profile.securityMirror(config.Architecture)
+		}
+		if len(sources.Components) == 0 {
+			sources.Components = config.Components
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLookupProfile(t *testing.T) {
+	for _, distribution := range []string{DistributionDebian, DistributionUbuntu, DistributionDevuan, DistributionKali, DistributionRaspbian} {
+		profile, err := lookupProfile(distribution)
+		if err != nil {
+			t.Fatalf("expected profile for '%s', got: %s", distribution, err)
+		}
+		if profile.Bootstrapper != BootstrapperDebootstrap || profile.DebootstrapScript == "" || profile.defaultMirror("armhf") == "" {
+			t.Errorf("incomplete profile for '%s': %+v", distribution, profile)
+		}
+	}
+
+	if _, err := lookupProfile("gentoo"); err == nil || !strings.Contains(err.Error(), "debian") {
+		t.Errorf("expected error listing supported distributions, got: %v", err)
+	}
+}
+
+func TestProfileDefaultMirror(t *testing.T) {
+	ubuntu := DistributionProfiles[DistributionUbuntu]
+	if mirror := ubuntu.defaultMirror("amd64"); mirror != "http://archive.ubuntu.com/ubuntu" {
+		t.Errorf("unexpected mirror for amd64: %s", mirror)
+	}
+	if mirror := ubuntu.defaultMirror("arm64"); mirror != "http://ports.ubuntu.com/ubuntu-ports" {
+		t.Errorf("expected ports mirror for arm64, got: %s", mirror)
+	}
+}
+
+func TestProfileCheck(t *testing.T) {
+	cases := []struct {
+		distribution string
+		release      string
+		arch         string
+		valid        bool
+	}{
+		{DistributionDebian, "bookworm", "arm64", true},
+		{DistributionUbuntu, "noble", "riscv64", false},
+		{DistributionUbuntu, "bookworm", "amd64", false},
+		{DistributionRaspbian, "bookworm", "armhf", true},
+		{DistributionRaspbian, "bookworm", "arm64", false},
+		{DistributionKali, "kali-rolling", "amd64", true},
+		// Releases are not restricted
+		{DistributionAlpine, "v3.19", "arm64", true},
+	}
+	for _, c := range cases {
+		err := DistributionProfiles[c.distribution].check(c.distribution, c.release, c.arch, t.TempDir())
+		if (err == nil) != c.valid {
+			t.Errorf("%s %s %s: expected valid: %t, got: %v", c.distribution, c.release, c.arch, c.valid, err)
+		}
+	}
+}
+
+func TestApplyDistributionProfile(t *testing.T) {
+	config := &ConfigurationV1{Distribution: DistributionUbuntu, Release: "noble", Architecture: "arm64"}
+	applyDistributionProfile(config)
+	if config.Mirror != "http://ports.ubuntu.com/ubuntu-ports" {
+		t.Errorf("expected default mirror, got: %s", config.Mirror)
+	}
+	if strings.Join(config.Components, ",") != "main,universe" {
+		t.Errorf("expected default components, got: %v", config.Components)
+	}
+
+	config = &ConfigurationV1{Distribution: DistributionDebian, Mirror: "http://mirror.example.com/debian", Components: []string{"main", "contrib"}}
+	applyDistributionProfile(config)
+	if config.Mirror != "http://mirror.example.com/debian" || len(config.Components) != 2 {
+		t.Errorf("expected configured mirror and components to be kept, got: %s, %v", config.Mirror, config.Components)
+	}
+
+	config = &ConfigurationV1{Distribution: DistributionUbuntu, Architecture: "amd64", Mirror: "http://mirror.example.com/ubuntu", FinalSources: &FinalSourcesV1{}}
+	applyDistributionProfile(config)
+	final := config.FinalSources
+	if final.Mirror != "http://archive.ubuntu.com/ubuntu" || final.SecurityMirror != "http://security.ubuntu.com/ubuntu" {
+		t.Errorf("expected public mirrors in final sources, got: %s, %s", final.Mirror, final.SecurityMirror)
+	}
+	if strings.Join(final.Components, ",") != "main,universe" {
+		t.Errorf("expected components of the build in final sources, got: %v", final.Components)
+	}
+}
+
+func TestProfileKeyrings(t *testing.T) {
+	keyring := t.TempDir() + "/archive-keyring.gpg"
+	profile := &DistributionProfile{Keyring: keyring}
+	if keyrings := profile.keyrings(); len(keyrings) != 0 {
+		t.Errorf("expected missing keyring to be skipped, got: %v", keyrings)
+	}
+
+	if err := os.WriteFile(keyring, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if keyrings := profile.keyrings(); len(keyrings) != 1 || keyrings[0] != keyring {
+		t.Errorf("expected keyring, got: %v", keyrings)
+	}
+}
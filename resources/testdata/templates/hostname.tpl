@@ -0,0 +1 @@
+{{ container.name }}
@@ -0,0 +1,245 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Set in the environment of a builder re-executed in a user namespace
+	RootlessEnv = "ROOTFSBUILDER_ROOTLESS"
+	// Set until the IDs of the user namespace are mapped
+	IDMappingPendingEnv = "ROOTFSBUILDER_ID_MAPPING_PENDING"
+	SubUIDPath          = "/etc/subuid"
+	SubGIDPath          = "/etc/subgid"
+	// IDs needed for the system users and groups of a rootfs
+	MinSubIDCount = 65536
+	// Descriptor the re-executed builder waits on until its IDs are mapped
+	userNamespaceSyncFd = 3
+)
+
+// A range of subordinate user or group IDs
+type idRange struct {
+	Start uint32
+	Count uint32
+}
+
+// Reports whether the builder runs rootless, in the user namespace created
+// by runInUserNamespace
+func isRootless() bool {
+	return os.Getenv(RootlessEnv) == "1"
+}
+
+// Returns the first range of at least MinSubIDCount IDs for a user in
+// /etc/subuid or /etc/subgid. Entries refer to the user by name or ID.
+func parseSubIDs(r io.Reader, name string, id string) (idRange, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// user:start:count
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != id) {
+			continue
+		}
+
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return idRange{}, fmt.Errorf("invalid entry '%s': %w", line, err)
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return idRange{}, fmt.Errorf("invalid entry '%s': %w", line, err)
+		}
+
+		if count >= MinSubIDCount {
+			return idRange{Start: uint32(start), Count: uint32(count)}, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return idRange{}, err
+	}
+
+	return idRange{}, fmt.Errorf("no range of at least %d IDs for user '%s'", MinSubIDCount, name)
+}
+
+func readSubIDs(path string, u *user.User) (idRange, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return idRange{}, fmt.Errorf("error while reading '%s': %w", path, err)
+	}
+	defer fd.Close()
+
+	ids, err := parseSubIDs(fd, u.Username, u.Uid)
+	if err != nil {
+		return idRange{}, fmt.Errorf("error while reading '%s': %w", path, err)
+	}
+
+	return ids, nil
+}
+
+// Returns the arguments of newuidmap or newgidmap: the own ID becomes root,
+// and the subordinate IDs are mapped from 1 on
+func idMapArgs(pid int, id string, ids idRange) []string {
+	return []string{
+		strconv.Itoa(pid),
+		"0", id, "1",
+		"1", strconv.FormatUint(uint64(ids.Start), 10), strconv.FormatUint(uint64(ids.Count), 10),
+	}
+}
+
+// Returns a command that re-executes the builder with the same arguments
+// in new user, mount, and PID namespaces. The PID namespace is needed to
+// mount proc. The builder waits on sync until its IDs are mapped.
+func newUserNamespaceCommand(args []string, sync *os.File) *exec.Cmd {
+	cmd := exec.Command("/proc/self/exe", args[1:]...)
+	cmd.Args[0] = args[0]
+	cmd.Env = append(os.Environ(), MountNamespaceEnv+"=1", RootlessEnv+"=1", IDMappingPendingEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{sync}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID,
+		// Do not outlive the parent
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	return cmd
+}
+
+// Re-executes the builder as root of a user namespace, with the calling
+// user's subordinate IDs mapped by newuidmap and newgidmap. Files created
+// in the rootfs are owned by the subordinate IDs on the host, and by the
+// expected users and groups in the namespace, where the outputs are
+// written. Returns the exit code of the builder.
+func runInUserNamespace(args []string) (int, error) {
+	u, err := user.Current()
+	if err != nil {
+		return ExitCodeFailure, fmt.Errorf("error while looking up current user: %w", err)
+	}
+
+	subUIDs, err := readSubIDs(SubUIDPath, u)
+	if err != nil {
+		return ExitCodeFailure, err
+	}
+	subGIDs, err := readSubIDs(SubGIDPath, u)
+	if err != nil {
+		return ExitCodeFailure, err
+	}
+
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err = exec.LookPath(tool); err != nil {
+			return ExitCodeFailure, fmt.Errorf("rootless builds require '%s' (uidmap package)", tool)
+		}
+	}
+
+	syncReader, syncWriter, err := os.Pipe()
+	if err != nil {
+		return ExitCodeFailure, err
+	}
+	defer syncWriter.Close()
+
+	cmd := newUserNamespaceCommand(args, syncReader)
+
+	// See runInMountNamespace
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	err = cmd.Start()
+	syncReader.Close()
+	if err != nil {
+		return ExitCodeFailure, fmt.Errorf("error while creating user namespace: %w", err)
+	}
+
+	pid := cmd.Process.Pid
+	maps := []*exec.Cmd{
+		exec.Command("newuidmap", idMapArgs(pid, u.Uid, subUIDs)...),
+		exec.Command("newgidmap", idMapArgs(pid, u.Gid, subGIDs)...),
+	}
+	for _, mapCmd := range maps {
+		mapCmd.Stderr = os.Stderr
+		if err = mapCmd.Run(); err != nil {
+			// Closing the pipe without a byte makes the builder exit
+			syncWriter.Close()
+			_ = cmd.Wait()
+			return ExitCodeFailure, fmt.Errorf("error while running %s: %w", mapCmd.Args[0], err)
+		}
+	}
+
+	if _, err = syncWriter.Write([]byte{0}); err != nil {
+		return ExitCodeFailure, err
+	}
+	syncWriter.Close()
+
+	return waitForBuilder(cmd, signals)
+}
+
+// Reports whether the builder waits for the IDs of its user namespace to be
+// mapped
+func idMappingPending() bool {
+	return os.Getenv(IDMappingPendingEnv) == "1"
+}
+
+// Waits until the parent has mapped the IDs of the user namespace, and
+// re-executes the builder. It was executed before it was mapped to root,
+// which dropped its capabilities in the namespace.
+func enterUserNamespace() error {
+	sync := os.NewFile(userNamespaceSyncFd, "sync")
+	buf := make([]byte, 1)
+	n, _ := sync.Read(buf)
+	sync.Close()
+	if n != 1 {
+		return fmt.Errorf("user namespace ID mapping failed")
+	}
+
+	env := []string{}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, IDMappingPendingEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	return syscall.Exec("/proc/self/exe", os.Args, env)
+}
+
+// Device nodes cannot be created in a user namespace, so a rootless rootfs
+// lacks them, or has empty placeholder files. They are added to archives of
+// the rootfs instead, like debootstrap creates them.
+var rootlessDevices = map[string]tarDevice{
+	"/dev/null":    {Mode: 0666, Major: 1, Minor: 3},
+	"/dev/zero":    {Mode: 0666, Major: 1, Minor: 5},
+	"/dev/full":    {Mode: 0666, Major: 1, Minor: 7},
+	"/dev/random":  {Mode: 0666, Major: 1, Minor: 8},
+	"/dev/urandom": {Mode: 0666, Major: 1, Minor: 9},
+	"/dev/tty":     {Mode: 0666, Major: 5, Minor: 0},
+	"/dev/console": {Mode: 0600, Major: 5, Minor: 1},
+	"/dev/ptmx":    {Mode: 0666, Major: 5, Minor: 2},
+}
+
+// Returns the device nodes added to archives of the rootfs
+func (b *Builder) archiveDevices() map[string]tarDevice {
+	if !b.rootless {
+		return nil
+	}
+
+	return rootlessDevices
+}
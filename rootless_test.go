@@ -0,0 +1,86 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	data := "# comment\nalice:100000:65536\nbob:165536:1000\n1001:300000:65536\nbob:400000:65536\n"
+
+	ids, err := parseSubIDs(strings.NewReader(data), "alice", "1000")
+	if err != nil || ids.Start != 100000 || ids.Count != 65536 {
+		t.Errorf("expected range of alice, got: %+v, %v", ids, err)
+	}
+
+	// Ranges too small for a rootfs are skipped
+	ids, err = parseSubIDs(strings.NewReader(data), "bob", "1002")
+	if err != nil || ids.Start != 400000 {
+		t.Errorf("expected second range of bob, got: %+v, %v", ids, err)
+	}
+
+	ids, err = parseSubIDs(strings.NewReader(data), "carol", "1001")
+	if err != nil || ids.Start != 300000 {
+		t.Errorf("expected range by user ID, got: %+v, %v", ids, err)
+	}
+
+	if _, err = parseSubIDs(strings.NewReader(data), "dave", "1003"); err == nil {
+		t.Error("expected error for user without range")
+	}
+	if _, err = parseSubIDs(strings.NewReader("dave:x:65536\n"), "dave", "1003"); err == nil {
+		t.Error("expected error for malformed entry")
+	}
+}
+
+func TestIDMapArgs(t *testing.T) {
+	args := idMapArgs(42, "1000", idRange{Start: 100000, Count: 65536})
+
+	if strings.Join(args, " ") != "42 0 1000 1 1 100000 65536" {
+		t.Errorf("unexpected arguments: %v", args)
+	}
+}
+
+func TestNewUserNamespaceCommand(t *testing.T) {
+	sync, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sync.Close()
+
+	cmd := newUserNamespaceCommand([]string{"rootfsbuilder", "config.json"}, sync)
+
+	flags := cmd.SysProcAttr.Cloneflags
+	if flags&syscall.CLONE_NEWUSER == 0 || flags&syscall.CLONE_NEWNS == 0 || flags&syscall.CLONE_NEWPID == 0 {
+		t.Error("expected new user, mount, and PID namespaces")
+	}
+	if len(cmd.ExtraFiles) != 1 || cmd.ExtraFiles[0] != sync {
+		t.Errorf("expected sync pipe as descriptor %d", userNamespaceSyncFd)
+	}
+
+	env := strings.Join(cmd.Env, "\n")
+	for _, marker := range []string{MountNamespaceEnv, RootlessEnv, IDMappingPendingEnv} {
+		if !strings.Contains(env, marker+"=1") {
+			t.Errorf("expected '%s' to be set", marker)
+		}
+	}
+}
+
+func TestArchiveDevices(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	if builder.archiveDevices() != nil {
+		t.Error("expected no devices to be added for rootful builds")
+	}
+
+	builder.rootless = true
+	if devices := builder.archiveDevices(); devices["/dev/null"].Major != 1 || devices["/dev/null"].Minor != 3 {
+		t.Errorf("expected /dev/null to be added, got: %v", devices)
+	}
+}
@@ -0,0 +1,167 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	AptSourcesListPath = "/etc/apt/sources.list"
+	AptSourcesDir      = "/etc/apt/sources.list.d"
+	// One-line-style /etc/apt/sources.list
+	SourcesFormatList = "list"
+	// deb822-style .sources file in /etc/apt/sources.list.d
+	SourcesFormatDeb822 = "deb822"
+)
+
+// Suites of a release on one mirror
+type aptSource struct {
+	URI        string
+	Suites     []string
+	Components []string
+}
+
+func checkFinalSources(sources *FinalSourcesV1, profile *DistributionProfile) error {
+	if profile.DebootstrapScript == "" {
+		return fmt.Errorf("final sources are only supported for Debian-based distributions")
+	}
+	if sources.Format != "" && sources.Format != SourcesFormatList && sources.Format != SourcesFormatDeb822 {
+		return fmt.Errorf("unsupported format '%s', supported: %s, %s", sources.Format, SourcesFormatList, SourcesFormatDeb822)
+	}
+	if sources.Mirror == "" {
+		return fmt.Errorf("mirror is required")
+	}
+	if len(sources.Components) == 0 {
+		return fmt.Errorf("components are required")
+	}
+
+	return nil
+}
+
+// Returns the updates and security suites of a release, empty if the
+// distribution or release has none
+func (p *DistributionProfile) updatesSuites(release string) (string, string) {
+	if containsString(p.RollingSuites, release) {
+		return "", ""
+	}
+
+	updates, security := "", ""
+	if p.UpdatesSuite != "" {
+		updates = fmt.Sprintf(p.UpdatesSuite, release)
+	}
+	if suite, ok := p.SecuritySuites[release]; ok {
+		security = suite
+	} else if p.SecuritySuite != "" {
+		security = fmt.Sprintf(p.SecuritySuite, release)
+	}
+
+	return updates, security
+}
+
+// Returns the sources shipped in the rootfs: the release and its updates
+// suite on the mirror, and its security suite on the security mirror
+func finalSources(config *ConfigurationV1, profile *DistributionProfile) []aptSource {
+	final := config.FinalSources
+	updates, security := profile.updatesSuites(config.Release)
+
+	suites := []string{config.Release}
+	if updates != "" && !final.NoUpdates {
+		suites = append(suites, updates)
+	}
+	sources := []aptSource{{URI: final.Mirror, Suites: suites, Components: final.Components}}
+
+	if security != "" && !final.NoSecurity {
+		if final.SecurityMirror == final.Mirror {
+			sources[0].Suites = append(sources[0].Suites, security)
+		} else {
+			sources = append(sources, aptSource{URI: final.SecurityMirror, Suites: []string{security}, Components: final.Components})
+		}
+	}
+
+	return sources
+}
+
+func formatSourcesList(sources []aptSource) []byte {
+	var buf bytes.Buffer
+	for _, source := range sources {
+		for _, suite := range source.Suites {
+			fmt.Fprintf(&buf, "deb %s %s %s\n", source.URI, suite, strings.Join(source.Components, " "))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func formatDeb822(sources []aptSource) []byte {
+	var buf bytes.Buffer
+	for i, source := range sources {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "Types: deb\n")
+		fmt.Fprintf(&buf, "URIs: %s\n", source.URI)
+		fmt.Fprintf(&buf, "Suites: %s\n", strings.Join(source.Suites, " "))
+		fmt.Fprintf(&buf, "Components: %s\n", strings.Join(source.Components, " "))
+	}
+
+	return buf.Bytes()
+}
+
+// Returns the format of the sources in the rootfs: deb822, if there is no
+// sources.list but .sources files
+func (b *Builder) sourcesFormat() string {
+	if b.config.FinalSources.Format != "" {
+		return b.config.FinalSources.Format
+	}
+
+	if info, err := os.Stat(filepath.Join(b.rootfs, AptSourcesListPath)); err == nil && info.Size() > 0 {
+		return SourcesFormatList
+	}
+	if matches, _ := filepath.Glob(filepath.Join(b.rootfs, AptSourcesDir, "*.sources")); len(matches) > 0 {
+		return SourcesFormatDeb822
+	}
+
+	return SourcesFormatList
+}
+
+// Replaces the sources of the build mirror with the final sources, after
+// the post install command and before the rootfs is packaged. Other files
+// in sources.list.d are kept.
+func (b *Builder) writeFinalSources() error {
+	profile, err := lookupProfile(b.config.Distribution)
+	if err != nil {
+		return err
+	}
+	sources := finalSources(b.config, profile)
+
+	switch b.sourcesFormat() {
+	case SourcesFormatDeb822:
+		target := filepath.Join(AptSourcesDir, b.config.Distribution+".sources")
+		fmt.Fprintf(b.loggerErr, "Writing final sources to '%s'\n", target)
+		if err = os.MkdirAll(filepath.Join(b.rootfs, AptSourcesDir), 0755); err != nil {
+			return err
+		}
+		if err = replaceFile(filepath.Join(b.rootfs, target), formatDeb822(sources), 0644); err != nil {
+			return err
+		}
+		if err = os.Remove(filepath.Join(b.rootfs, AptSourcesListPath)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	default:
+		fmt.Fprintf(b.loggerErr, "Writing final sources to '%s'\n", AptSourcesListPath)
+		if err = replaceFile(filepath.Join(b.rootfs, AptSourcesListPath), formatSourcesList(sources), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
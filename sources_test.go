@@ -0,0 +1,128 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCheckFinalSources(t *testing.T) {
+	sources := &FinalSourcesV1{Mirror: "http://deb.debian.org/debian", Components: []string{"main"}}
+	if err := checkFinalSources(sources, DistributionProfiles[DistributionDebian]); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+	if err := checkFinalSources(sources, DistributionProfiles[DistributionAlpine]); err == nil {
+		t.Error("expected error for Alpine Linux")
+	}
+
+	sources.Format = "yaml"
+	if err := checkFinalSources(sources, DistributionProfiles[DistributionDebian]); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestFinalSources(t *testing.T) {
+	cases := []struct {
+		distribution string
+		release      string
+		arch         string
+		final        FinalSourcesV1
+		expected     string
+	}{
+		{
+			DistributionDebian, "bookworm", "arm64", FinalSourcesV1{},
+			"deb http://deb.debian.org/debian bookworm main\n" +
+				"deb http://deb.debian.org/debian bookworm-updates main\n" +
+				"deb http://security.debian.org/debian-security bookworm-security main\n",
+		},
+		{
+			DistributionDebian, "buster", "amd64", FinalSourcesV1{NoUpdates: true},
+			"deb http://deb.debian.org/debian buster main\n" +
+				"deb http://security.debian.org/debian-security buster/updates main\n",
+		},
+		{
+			DistributionDebian, "sid", "amd64", FinalSourcesV1{},
+			"deb http://deb.debian.org/debian sid main\n",
+		},
+		{
+			// The security suite is on the ports mirror
+			DistributionUbuntu, "noble", "arm64", FinalSourcesV1{},
+			"deb http://ports.ubuntu.com/ubuntu-ports noble main universe\n" +
+				"deb http://ports.ubuntu.com/ubuntu-ports noble-updates main universe\n" +
+				"deb http://ports.ubuntu.com/ubuntu-ports noble-security main universe\n",
+		},
+		{
+			DistributionKali, "kali-rolling", "amd64", FinalSourcesV1{},
+			"deb http://http.kali.org/kali kali-rolling main contrib non-free non-free-firmware\n",
+		},
+	}
+	for _, c := range cases {
+		config := &ConfigurationV1{Distribution: c.distribution, Release: c.release, Architecture: c.arch, FinalSources: &c.final}
+		applyDistributionProfile(config)
+
+		sources := finalSources(config, DistributionProfiles[c.distribution])
+		if data := formatSourcesList(sources); string(data) != c.expected {
+			t.Errorf("%s %s: unexpected sources.list: %q", c.distribution, c.release, data)
+		}
+	}
+}
+
+func TestFormatDeb822(t *testing.T) {
+	sources := []aptSource{
+		{URI: "http://deb.debian.org/debian", Suites: []string{"trixie", "trixie-updates"}, Components: []string{"main"}},
+		{URI: "http://security.debian.org/debian-security", Suites: []string{"trixie-security"}, Components: []string{"main"}},
+	}
+
+	expected := "Types: deb\nURIs: http://deb.debian.org/debian\nSuites: trixie trixie-updates\nComponents: main\n\n" +
+		"Types: deb\nURIs: http://security.debian.org/debian-security\nSuites: trixie-security\nComponents: main\n"
+	if data := formatDeb822(sources); string(data) != expected {
+		t.Errorf("unexpected deb822 sources: %q", data)
+	}
+}
+
+func TestWriteFinalSources(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	builder.config.FinalSources = &FinalSourcesV1{}
+	applyDistributionProfile(builder.config)
+
+	// Written by debootstrap
+	if err := os.MkdirAll(builder.rootfs+AptSourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(builder.rootfs+AptSourcesListPath, []byte("deb http://mirror.internal/debian bookworm main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := builder.writeFinalSources(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	expected := "deb http://deb.debian.org/debian bookworm main\n" +
+		"deb http://deb.debian.org/debian bookworm-updates main\n" +
+		"deb http://security.debian.org/debian-security bookworm-security main\n"
+	if data, _ := os.ReadFile(builder.rootfs + AptSourcesListPath); string(data) != expected {
+		t.Errorf("unexpected sources.list: %q", data)
+	}
+
+	// Only deb822 sources
+	if err := os.Remove(builder.rootfs + AptSourcesListPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(builder.rootfs+AptSourcesDir+"/debian.sources", []byte("Types: deb\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := builder.writeFinalSources(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if data, _ := os.ReadFile(builder.rootfs + AptSourcesDir + "/debian.sources"); string(data) == "Types: deb\n" {
+		t.Errorf("expected deb822 sources to be replaced, got: %q", data)
+	}
+	if _, err := os.Stat(builder.rootfs + AptSourcesListPath); !os.IsNotExist(err) {
+		t.Errorf("expected no sources.list, got: %v", err)
+	}
+}
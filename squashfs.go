@@ -0,0 +1,27 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Creates a xz compressed squashfs image of the source directory
+func (b *Builder) makeSquashfs(sourceDir string, imagePath string) error {
+	cmd := exec.Command("mksquashfs", sourceDir, imagePath, "-noappend", "-comp", "xz", "-no-progress")
+	cmd.Stdout = b.loggerOut
+	cmd.Stderr = b.loggerErr
+
+	fmt.Fprintf(b.loggerErr, "Running mksquashfs with args: %s\n", strings.Join(cmd.Args, " "))
+	if err := b.runCommand(cmd); err != nil {
+		return fmt.Errorf("error while running mksquashfs: %w", err)
+	}
+
+	return nil
+}
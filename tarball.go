@@ -0,0 +1,656 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// PAX record prefixes used by GNU tar and libarchive
+	paxXattrPrefix = "SCHILY.xattr."
+	paxACLAccess   = "SCHILY.acl.access"
+	paxACLDefault  = "SCHILY.acl.default"
+
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+
+	// lseek whence values for finding the data regions of sparse files
+	seekData = 3
+	seekHole = 4
+
+	tarBlockSize = 512
+	// Largest values of the 7 and 11 digit octal ustar fields
+	tarMaxOctal7  = 07777777
+	tarMaxOctal11 = 077777777777
+	// Interval between progress messages
+	tarProgressInterval = 5 * time.Second
+)
+
+// POSIX ACL entry tags, as stored in the system.posix_acl_* xattrs
+var aclTags = map[uint16]string{
+	0x01: "user",
+	0x02: "user",
+	0x04: "group",
+	0x08: "group",
+	0x10: "mask",
+	0x20: "other",
+}
+
+type tarOptions struct {
+	// Replaces the leading "." of member names (e.g. "rootfs")
+	Prefix string
+	// Absolute paths in the tree that are left out. May contain wildcards.
+	Exclude []string
+	// Receives progress messages, if set
+	Progress io.Writer
+	// Character devices added by absolute path, unless the tree has them.
+	// Empty regular files at these paths are replaced.
+	Devices map[string]tarDevice
+}
+
+type tarDevice struct {
+	Mode  int64
+	Major int64
+	Minor int64
+}
+
+// A tar.Writer that can also write raw entries, for the sparse headers
+// archive/tar refuses to encode
+type treeTarWriter struct {
+	*tar.Writer
+	raw io.Writer
+}
+
+func newTreeTarWriter(w io.Writer) *treeTarWriter {
+	return &treeTarWriter{Writer: tar.NewWriter(w), raw: w}
+}
+
+// A data region of a sparse file
+type sparseSegment struct {
+	Offset int64
+	Length int64
+}
+
+// Reports the progress of writing a tarball at most every
+// tarProgressInterval.
+type tarProgress struct {
+	w          io.Writer
+	entries    int
+	bytes      int64
+	lastReport time.Time
+}
+
+func (p *tarProgress) add(size int64) {
+	p.entries++
+	p.bytes += size
+
+	if p.w == nil || time.Since(p.lastReport) < tarProgressInterval {
+		return
+	}
+	p.lastReport = time.Now()
+	p.report()
+}
+
+func (p *tarProgress) report() {
+	if p.w != nil {
+		fmt.Fprintf(p.w, "Archived %d entries (%d MiB)\n", p.entries, p.bytes/(1024*1024))
+	}
+}
+
+// Converts a system.posix_acl_* xattr to the text form stored by GNU tar,
+// with numeric IDs (e.g. "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r-x").
+func aclToText(data []byte) (string, error) {
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != 2 || (len(data)-4)%8 != 0 {
+		return "", fmt.Errorf("malformed ACL")
+	}
+
+	entries := []string{}
+	for offset := 4; offset < len(data); offset += 8 {
+		tag := binary.LittleEndian.Uint16(data[offset:])
+		perm := binary.LittleEndian.Uint16(data[offset+2:])
+		id := binary.LittleEndian.Uint32(data[offset+4:])
+
+		name, ok := aclTags[tag]
+		if !ok {
+			return "", fmt.Errorf("unknown ACL tag 0x%x", tag)
+		}
+
+		qualifier := ""
+		if tag == 0x02 || tag == 0x08 {
+			qualifier = strconv.FormatUint(uint64(id), 10)
+		}
+
+		perms := []byte("---")
+		if perm&4 != 0 {
+			perms[0] = 'r'
+		}
+		if perm&2 != 0 {
+			perms[1] = 'w'
+		}
+		if perm&1 != 0 {
+			perms[2] = 'x'
+		}
+
+		entries = append(entries, name+":"+qualifier+":"+string(perms))
+	}
+
+	return strings.Join(entries, ","), nil
+}
+
+// Reads the extended attributes of a file into PAX records. POSIX ACLs are
+// stored in text form, like 'tar --acls' does.
+func xattrRecords(filePath string) (map[string]string, error) {
+	size, err := syscall.Listxattr(filePath, nil)
+	if err == syscall.ENOTSUP || size == 0 {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error while listing xattrs of '%s': %w", filePath, err)
+	}
+
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(filePath, names); err != nil {
+		return nil, fmt.Errorf("error while listing xattrs of '%s': %w", filePath, err)
+	}
+
+	records := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := getXattr(filePath, name)
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error while reading xattr '%s' of '%s': %w", name, filePath, err)
+		}
+
+		switch name {
+		case xattrACLAccess, xattrACLDefault:
+			text, err := aclToText(value)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading ACL of '%s': %w", filePath, err)
+			}
+			if name == xattrACLAccess {
+				records[paxACLAccess] = text
+			} else {
+				records[paxACLDefault] = text
+			}
+		default:
+			records[paxXattrPrefix+name] = string(value)
+		}
+	}
+
+	return records, nil
+}
+
+func getXattr(filePath string, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(filePath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	if size, err = syscall.Getxattr(filePath, name, value); err != nil {
+		return nil, err
+	}
+
+	return value[:size], nil
+}
+
+// Returns the data regions of a file, or nil if the filesystem cannot
+// report them.
+func sparseSegments(fd *os.File, size int64) ([]sparseSegment, error) {
+	segments := []sparseSegment{}
+
+	offset := int64(0)
+	for offset < size {
+		start, err := fd.Seek(offset, seekData)
+		if err == nil {
+			end, err := fd.Seek(start, seekHole)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, sparseSegment{Offset: start, Length: end - start})
+			offset = end
+			continue
+		}
+
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENXIO {
+			// No more data until the end of the file
+			break
+		} else if ok && pathErr.Err == syscall.EINVAL {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// The end of the file must be recorded, if it is a hole
+	if len(segments) == 0 || segments[len(segments)-1].Offset+segments[len(segments)-1].Length < size {
+		segments = append(segments, sparseSegment{Offset: size, Length: 0})
+	}
+
+	return segments, nil
+}
+
+// Encodes the sparse map of the GNU PAX 1.0 sparse format, padded to a
+// full block.
+func sparseMap(segments []sparseSegment) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%d\n", len(segments))
+	for _, segment := range segments {
+		fmt.Fprintf(&buf, "%d\n%d\n", segment.Offset, segment.Length)
+	}
+
+	if rem := buf.Len() % tarBlockSize; rem != 0 {
+		buf.Write(make([]byte, tarBlockSize-rem))
+	}
+
+	return buf.Bytes()
+}
+
+// Writes a directory tree into a tarball. Members are named like those of
+// 'tar -C root .', with numeric ownership, hardlinks, sparse files, device
+// nodes, xattrs, and POSIX ACLs. The output does not depend on the host.
+func writeTreeTar(tw *treeTarWriter, root string, opts tarOptions) error {
+	prefix := opts.Prefix
+	if prefix == "" {
+		prefix = "."
+	}
+
+	links := map[[2]uint64]string{}
+	progress := &tarProgress{w: opts.Progress, lastReport: time.Now()}
+	// Modification times of the archived directories, for added devices
+	dirs := map[string]time.Time{}
+	devices := map[string]bool{}
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && tarExcluded(opts.Exclude, "/"+rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("unable to stat '%s'", filePath)
+		}
+
+		hdr := &tar.Header{
+			Name:    prefix + "/" + rel,
+			Mode:    int64(st.Mode & 07777),
+			Uid:     int(st.Uid),
+			Gid:     int(st.Gid),
+			ModTime: info.ModTime().Truncate(time.Second),
+		}
+		if rel == "." {
+			hdr.Name = prefix + "/"
+		}
+
+		switch info.Mode() & os.ModeType {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = info.Size()
+
+			if st.Nlink > 1 {
+				key := [2]uint64{uint64(st.Dev), st.Ino}
+				if first, ok := links[key]; ok {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					hdr.Size = 0
+				} else {
+					links[key] = hdr.Name
+				}
+			}
+		case os.ModeDir:
+			hdr.Typeflag = tar.TypeDir
+			if rel != "." {
+				hdr.Name += "/"
+			}
+			dirs[path.Clean("/"+rel)] = hdr.ModTime
+		case os.ModeSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			if hdr.Linkname, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		case os.ModeDevice:
+			hdr.Typeflag = tar.TypeBlock
+		case os.ModeDevice | os.ModeCharDevice:
+			hdr.Typeflag = tar.TypeChar
+		case os.ModeNamedPipe:
+			hdr.Typeflag = tar.TypeFifo
+		default:
+			// Sockets cannot be archived
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeBlock || hdr.Typeflag == tar.TypeChar {
+			major, minor := splitDevice(uint64(st.Rdev))
+			hdr.Devmajor, hdr.Devminor = int64(major), int64(minor)
+		}
+
+		if device, ok := opts.Devices["/"+rel]; ok {
+			devices["/"+rel] = true
+			if hdr.Typeflag == tar.TypeReg && hdr.Size == 0 {
+				hdr.Typeflag = tar.TypeChar
+				hdr.Mode = device.Mode
+				hdr.Devmajor, hdr.Devminor = device.Major, device.Minor
+			}
+		}
+
+		// xattrs of symlinks cannot be read without following them
+		if hdr.Typeflag != tar.TypeSymlink {
+			if hdr.PAXRecords, err = xattrRecords(filePath); err != nil {
+				return err
+			}
+		}
+
+		progress.add(hdr.Size)
+
+		if hdr.Typeflag != tar.TypeReg {
+			return tw.WriteHeader(hdr)
+		}
+
+		return writeTarFile(tw, hdr, filePath, st)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = writeTarDevices(tw, prefix, opts, dirs, devices); err != nil {
+		return err
+	}
+
+	progress.report()
+	return nil
+}
+
+func tarExcluded(exclude []string, absPath string) bool {
+	for _, pattern := range exclude {
+		if matched, _ := path.Match(pattern, absPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the devices of opts that are missing from the tree, if their
+// parent directory was archived
+func writeTarDevices(tw *treeTarWriter, prefix string, opts tarOptions, dirs map[string]time.Time, written map[string]bool) error {
+	paths := make([]string, 0, len(opts.Devices))
+	for devicePath := range opts.Devices {
+		paths = append(paths, devicePath)
+	}
+	sort.Strings(paths)
+
+	for _, devicePath := range paths {
+		modTime, ok := dirs[path.Dir(devicePath)]
+		if written[devicePath] || !ok || tarExcluded(opts.Exclude, devicePath) {
+			continue
+		}
+
+		device := opts.Devices[devicePath]
+		hdr := &tar.Header{
+			Typeflag: tar.TypeChar,
+			Name:     prefix + devicePath,
+			Mode:     device.Mode,
+			Devmajor: device.Major,
+			Devminor: device.Minor,
+			ModTime:  modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Writes a regular file. Sparse files are stored in the GNU PAX 1.0 sparse
+// format, so holes are not expanded.
+func writeTarFile(tw *treeTarWriter, hdr *tar.Header, filePath string, st *syscall.Stat_t) error {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var segments []sparseSegment
+	if hdr.Size > 0 && st.Blocks*512 < hdr.Size {
+		if segments, err = sparseSegments(fd, hdr.Size); err != nil {
+			return fmt.Errorf("error while reading holes of '%s': %w", filePath, err)
+		}
+	}
+
+	if segments == nil {
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = fd.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(tw, fd, hdr.Size); err != nil {
+			return fmt.Errorf("error while archiving '%s': %w", filePath, err)
+		}
+		return nil
+	}
+
+	sparseHeader := sparseMap(segments)
+	dataSize := int64(len(sparseHeader))
+	for _, segment := range segments {
+		dataSize += segment.Length
+	}
+
+	records := map[string]string{}
+	for key, value := range hdr.PAXRecords {
+		records[key] = value
+	}
+	records["GNU.sparse.major"] = "1"
+	records["GNU.sparse.minor"] = "0"
+	records["GNU.sparse.name"] = hdr.Name
+	records["GNU.sparse.realsize"] = strconv.FormatInt(hdr.Size, 10)
+
+	sparseHdr := *hdr
+	sparseHdr.Name = path.Join(path.Dir(hdr.Name), "GNUSparseFile.0", path.Base(hdr.Name))
+	sparseHdr.Size = dataSize
+
+	// Finish the previous entry, before writing to the raw writer
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	if err = writePAXHeader(tw.raw, &sparseHdr, records); err != nil {
+		return err
+	}
+	if _, err = tw.raw.Write(ustarHeader(&sparseHdr)); err != nil {
+		return err
+	}
+	if _, err = tw.raw.Write(sparseHeader); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if _, err = fd.Seek(segment.Offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = io.CopyN(tw.raw, fd, segment.Length); err != nil {
+			return fmt.Errorf("error while archiving '%s': %w", filePath, err)
+		}
+	}
+
+	if rem := dataSize % tarBlockSize; rem != 0 {
+		_, err = tw.raw.Write(make([]byte, tarBlockSize-rem))
+	}
+
+	return err
+}
+
+// Writes a PAX extended header entry with the given records. Values that
+// do not fit into the ustar header of hdr are added as records, and cleared
+// in hdr.
+func writePAXHeader(w io.Writer, hdr *tar.Header, records map[string]string) error {
+	if len(hdr.Name) > 100 {
+		records["path"] = hdr.Name
+		hdr.Name = hdr.Name[:100]
+	}
+	if hdr.Size > tarMaxOctal11 {
+		records["size"] = strconv.FormatInt(hdr.Size, 10)
+	}
+	if int64(hdr.Uid) > tarMaxOctal7 {
+		records["uid"] = strconv.Itoa(hdr.Uid)
+		hdr.Uid = 0
+	}
+	if int64(hdr.Gid) > tarMaxOctal7 {
+		records["gid"] = strconv.Itoa(hdr.Gid)
+		hdr.Gid = 0
+	}
+
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var data bytes.Buffer
+	for _, key := range keys {
+		data.WriteString(paxRecord(key, records[key]))
+	}
+
+	paxHdr := &tar.Header{
+		Name:     path.Join(path.Dir(hdr.Name), "PaxHeaders.0", path.Base(hdr.Name)),
+		Typeflag: tar.TypeXHeader,
+		Mode:     0644,
+		Size:     int64(data.Len()),
+		ModTime:  hdr.ModTime,
+	}
+	if len(paxHdr.Name) > 100 {
+		paxHdr.Name = paxHdr.Name[:100]
+	}
+
+	if rem := data.Len() % tarBlockSize; rem != 0 {
+		data.Write(make([]byte, tarBlockSize-rem))
+	}
+
+	if _, err := w.Write(ustarHeader(paxHdr)); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
+
+// Formats a PAX record, whose length prefix includes itself
+func paxRecord(key string, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record)
+	for size != len(strconv.Itoa(size))+len(record) {
+		size = len(strconv.Itoa(size)) + len(record)
+	}
+
+	return strconv.Itoa(size) + record
+}
+
+// Encodes a ustar header block. Values that are too large for their
+// fields are written as zero, and must be passed as PAX records.
+func ustarHeader(hdr *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+
+	octal := func(field []byte, value int64) {
+		if value < 0 || len(fmt.Sprintf("%o", value)) > len(field)-1 {
+			value = 0
+		}
+		copy(field, fmt.Sprintf("%0*o", len(field)-1, value))
+	}
+
+	copy(block[0:100], hdr.Name)
+	octal(block[100:108], hdr.Mode)
+	octal(block[108:116], int64(hdr.Uid))
+	octal(block[116:124], int64(hdr.Gid))
+	octal(block[124:136], hdr.Size)
+	octal(block[136:148], hdr.ModTime.Unix())
+	block[156] = hdr.Typeflag
+	copy(block[157:257], hdr.Linkname)
+	copy(block[257:265], "ustar\x0000")
+	octal(block[329:337], hdr.Devmajor)
+	octal(block[337:345], hdr.Devminor)
+
+	// The checksum is computed with the checksum field set to spaces
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return block
+}
+
+// Writes a tarball of the rootfs to w
+func (b *Builder) writeRootfsTar(w io.Writer, exclude []string) error {
+	tw := newTreeTarWriter(w)
+
+	err := writeTreeTar(tw, b.rootfs, tarOptions{Exclude: exclude, Progress: b.loggerErr, Devices: b.archiveDevices()})
+	if err != nil {
+		return fmt.Errorf("error while writing tarball: %w", err)
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("error while writing tarball: %w", err)
+	}
+
+	return nil
+}
+
+// Creates a tarball of the rootfs with the given compression. We do not
+// want a leading directory, and we want to preserve all file attributes,
+// and permissions.
+func (b *Builder) writeTarball(tarballPath string, compression string, exclude []string) error {
+	fd, err := os.Create(tarballPath)
+	if err != nil {
+		return fmt.Errorf("error while creating tarball: %w", err)
+	}
+	defer fd.Close()
+
+	compressor, err := b.newCompressor(fd, compression)
+	if err != nil {
+		return err
+	}
+
+	if err = b.writeRootfsTar(compressor, exclude); err != nil {
+		compressor.Close()
+		return err
+	}
+
+	if err = compressor.Close(); err != nil {
+		return fmt.Errorf("error while compressing tarball: %w", err)
+	}
+
+	return fd.Close()
+}
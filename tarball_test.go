@@ -0,0 +1,245 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// Encodes a system.posix_acl_* xattr
+func testACL(entries ...[3]uint32) []byte {
+	data := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(data, 2)
+	for i, entry := range entries {
+		binary.LittleEndian.PutUint16(data[4+8*i:], uint16(entry[0]))
+		binary.LittleEndian.PutUint16(data[6+8*i:], uint16(entry[1]))
+		binary.LittleEndian.PutUint32(data[8+8*i:], entry[2])
+	}
+	return data
+}
+
+func readTestTar(t *testing.T, data []byte) (map[string]*tar.Header, map[string][]byte) {
+	headers := map[string]*tar.Header{}
+	contents := map[string][]byte{}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[hdr.Name] = hdr
+		contents[hdr.Name] = content
+	}
+
+	return headers, contents
+}
+
+func TestACLToText(t *testing.T) {
+	acl := testACL([3]uint32{0x01, 7, 0xffffffff}, [3]uint32{0x02, 5, 1000},
+		[3]uint32{0x04, 5, 0xffffffff}, [3]uint32{0x10, 5, 0xffffffff}, [3]uint32{0x20, 4, 0xffffffff})
+
+	text, err := aclToText(acl)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	expected := "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r--"
+	if text != expected {
+		t.Errorf("expected '%s', got '%s'", expected, text)
+	}
+
+	if _, err = aclToText([]byte{1, 0, 0, 0}); err == nil {
+		t.Error("expected error for unsupported ACL version")
+	}
+}
+
+func TestSparseMap(t *testing.T) {
+	data := sparseMap([]sparseSegment{{Offset: 0, Length: 4096}, {Offset: 1 << 20, Length: 0}})
+
+	if len(data) != tarBlockSize {
+		t.Errorf("expected the map to be padded to a block, got %d bytes", len(data))
+	}
+	if !bytes.HasPrefix(data, []byte("2\n0\n4096\n1048576\n0\n\x00")) {
+		t.Errorf("unexpected sparse map: %q", data[:24])
+	}
+}
+
+func TestWriteTreeTar(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(root+"/usr/share/doc", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(root+"/usr/share/doc/README", []byte("docs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(root+"/usr/busybox", []byte("busybox"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	hasXattr := syscall.Setxattr(root+"/usr/busybox", "user.test", []byte("value"), 0) == nil
+	if err := os.Chown(root+"/usr/busybox", 1000, 1000); err != nil && os.Geteuid() == 0 {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(root+"/usr/busybox", os.ModeSetuid|0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(root+"/usr/busybox", root+"/usr/sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", root+"/usr/ash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(root+"/fifo", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sparse file with a single data block in the middle
+	sparse, err := os.Create(root + "/sparse.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sparse.WriteAt([]byte("data"), 1<<19); err != nil {
+		t.Fatal(err)
+	}
+	if err = sparse.Truncate(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	sparse.Close()
+
+	hasDevice := syscall.Mknod(root+"/console", syscall.S_IFCHR|0600, 5<<8|1) == nil
+
+	var buf bytes.Buffer
+	tw := newTreeTarWriter(&buf)
+	if err = writeTreeTar(tw, root, tarOptions{Prefix: "rootfs", Exclude: []string{"/usr/share/doc/*"}}); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, contents := readTestTar(t, buf.Bytes())
+
+	for _, name := range []string{"rootfs/", "rootfs/usr/", "rootfs/usr/share/doc/"} {
+		if hdr, ok := headers[name]; !ok || hdr.Typeflag != tar.TypeDir {
+			t.Errorf("expected directory '%s'", name)
+		}
+	}
+	if _, ok := headers["rootfs/usr/share/doc/README"]; ok {
+		t.Error("expected excluded file to be left out")
+	}
+
+	busybox := headers["rootfs/usr/busybox"]
+	if busybox == nil || busybox.Mode != 04755 || string(contents["rootfs/usr/busybox"]) != "busybox" {
+		t.Fatalf("expected setuid busybox, got: %+v", busybox)
+	}
+	if os.Geteuid() == 0 && (busybox.Uid != 1000 || busybox.Gid != 1000 || busybox.Uname != "") {
+		t.Errorf("expected numeric ownership 1000:1000, got %d:%d (%s)", busybox.Uid, busybox.Gid, busybox.Uname)
+	}
+	if hasXattr && busybox.PAXRecords["SCHILY.xattr.user.test"] != "value" {
+		t.Errorf("expected xattr record, got: %v", busybox.PAXRecords)
+	}
+
+	if sh := headers["rootfs/usr/sh"]; sh == nil || sh.Typeflag != tar.TypeLink || sh.Linkname != "rootfs/usr/busybox" {
+		t.Errorf("expected hardlink to busybox, got: %+v", sh)
+	}
+	if ash := headers["rootfs/usr/ash"]; ash == nil || ash.Typeflag != tar.TypeSymlink || ash.Linkname != "busybox" {
+		t.Errorf("expected symlink to busybox, got: %+v", ash)
+	}
+	if fifo := headers["rootfs/fifo"]; fifo == nil || fifo.Typeflag != tar.TypeFifo {
+		t.Errorf("expected fifo, got: %+v", fifo)
+	}
+	if hasDevice {
+		if console := headers["rootfs/console"]; console == nil || console.Typeflag != tar.TypeChar || console.Devmajor != 5 || console.Devminor != 1 {
+			t.Errorf("expected character device 5:1, got: %+v", console)
+		}
+	}
+
+	image := contents["rootfs/sparse.img"]
+	if len(image) != 1<<20 || string(image[1<<19:1<<19+4]) != "data" {
+		t.Errorf("expected sparse file to be restored, got %d bytes", len(image))
+	}
+	if info, err := os.Stat(root + "/sparse.img"); err == nil {
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Blocks*512 < info.Size() && len(buf.Bytes()) > 1<<19 {
+			t.Errorf("expected holes not to be stored, tarball has %d bytes", len(buf.Bytes()))
+		}
+	}
+}
+
+func TestWriteTreeTarDevices(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(root+"/dev", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Placeholder, as left by a rootless bootstrap
+	if err := os.WriteFile(root+"/dev/null", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := map[string]tarDevice{
+		"/dev/null":    {Mode: 0666, Major: 1, Minor: 3},
+		"/dev/zero":    {Mode: 0666, Major: 1, Minor: 5},
+		"/dev/console": {Mode: 0600, Major: 5, Minor: 1},
+		// No parent directory in the tree
+		"/missing/tty": {Mode: 0666, Major: 5, Minor: 0},
+	}
+
+	var buf bytes.Buffer
+	tw := newTreeTarWriter(&buf)
+	opts := tarOptions{Devices: devices, Exclude: []string{"/dev/console"}}
+	if err := writeTreeTar(tw, root, opts); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, _ := readTestTar(t, buf.Bytes())
+
+	for name, minor := range map[string]int64{"./dev/null": 3, "./dev/zero": 5} {
+		hdr := headers[name]
+		if hdr == nil || hdr.Typeflag != tar.TypeChar || hdr.Devmajor != 1 || hdr.Devminor != minor || hdr.Mode != 0666 {
+			t.Errorf("expected character device '%s', got: %+v", name, hdr)
+		}
+	}
+	for _, name := range []string{"./dev/console", "./missing/tty"} {
+		if _, ok := headers[name]; ok {
+			t.Errorf("expected '%s' to be left out", name)
+		}
+	}
+}
+
+func TestWriteTarballCompression(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	tarballPath := filepath.Join(t.TempDir(), "rootfs.tar.gz")
+
+	if err := builder.writeTarball(tarballPath, CompressionGzip, nil); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+
+	data, err := os.ReadFile(tarballPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Error("expected gzip compressed tarball")
+	}
+}
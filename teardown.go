@@ -0,0 +1,292 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Time child processes get to exit after being signalled, before they
+	// are killed
+	ChildGracePeriod = 10 * time.Second
+	// Additional time the build gets to stop after an interrupt, before the
+	// teardown is forced
+	InterruptTimeout = 5 * time.Second
+)
+
+type teardownStep struct {
+	id   int
+	name string
+	fn   func() error
+}
+
+// A stack of cleanup steps for the resources acquired during a build
+// (temporary directories, mounts, files injected into the rootfs, child
+// processes). The steps run in reverse order of registration.
+type Teardown struct {
+	mu     sync.Mutex
+	steps  []teardownStep
+	nextID int
+	logger io.Writer
+}
+
+func NewTeardown(logger io.Writer) *Teardown {
+	return &Teardown{logger: logger}
+}
+
+// Registers a cleanup step. The returned function runs the step early and
+// removes it from the stack, for resources released during the build. It
+// does nothing if the step already ran.
+func (t *Teardown) Push(name string, fn func() error) func() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := t.nextID
+	t.nextID++
+	t.steps = append(t.steps, teardownStep{id: id, name: name, fn: fn})
+
+	return func() error {
+		step, ok := t.remove(id)
+		if !ok {
+			return nil
+		}
+		return step.fn()
+	}
+}
+
+func (t *Teardown) remove(id int) (teardownStep, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, step := range t.steps {
+		if step.id == id {
+			t.steps = append(t.steps[:i], t.steps[i+1:]...)
+			return step, true
+		}
+	}
+
+	return teardownStep{}, false
+}
+
+func (t *Teardown) pop() (teardownStep, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.steps) == 0 {
+		return teardownStep{}, false
+	}
+
+	step := t.steps[len(t.steps)-1]
+	t.steps = t.steps[:len(t.steps)-1]
+	return step, true
+}
+
+// Runs all remaining steps in reverse order. A failing step does not stop
+// the teardown. Returns the first error.
+func (t *Teardown) Run() error {
+	var firstErr error
+	failed := 0
+
+	for {
+		step, ok := t.pop()
+		if !ok {
+			break
+		}
+
+		fmt.Fprintf(t.logger, "Teardown: %s\n", step.name)
+		if err := step.fn(); err != nil {
+			fmt.Fprintf(t.logger, "Teardown step '%s' failed: %s\n", step.name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error during teardown '%s': %w", step.name, err)
+			}
+			failed++
+		}
+	}
+
+	if failed > 1 {
+		return fmt.Errorf("%d teardown steps failed, first: %w", failed, firstErr)
+	}
+
+	return firstErr
+}
+
+// A running child process of the build
+type childProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// Sends sig to the process, and kills it if it has not exited after the
+// grace period.
+func (c *childProcess) stop(sig os.Signal, grace time.Duration) error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+
+	_ = c.cmd.Process.Signal(sig)
+
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(grace):
+	}
+
+	_ = c.cmd.Process.Kill()
+	return fmt.Errorf("killed '%s' after %s", c.cmd.Args[0], grace)
+}
+
+// Starts a command. While it runs, the process is registered on the
+// teardown stack, and receives the signals the build is interrupted with.
+// The returned function waits for it to exit.
+func (b *Builder) startCommand(cmd *exec.Cmd) (func() error, error) {
+	b.mu.Lock()
+	if b.interrupted != nil {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("build interrupted by %s", b.interrupted)
+	}
+
+	if err := cmd.Start(); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+
+	child := &childProcess{cmd: cmd, done: make(chan struct{})}
+	b.children[child] = true
+	b.mu.Unlock()
+
+	release := b.teardown.Push(fmt.Sprintf("stop '%s'", cmd.Args[0]), func() error {
+		return child.stop(syscall.SIGTERM, ChildGracePeriod)
+	})
+
+	wait := func() error {
+		err := cmd.Wait()
+		close(child.done)
+
+		b.mu.Lock()
+		delete(b.children, child)
+		b.mu.Unlock()
+
+		_ = release()
+		return err
+	}
+
+	return wait, nil
+}
+
+// Runs a command, registered like by startCommand
+func (b *Builder) runCommand(cmd *exec.Cmd) error {
+	wait, err := b.startCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	return wait()
+}
+
+// Creates a temporary directory that is unmounted and removed on teardown.
+// It is locked until then, so that 'rootfsbuilder cleanup' leaves it alone.
+// The returned function removes it early.
+func (b *Builder) makeTempDir(dir string, pattern string) (string, func() error, error) {
+	tempDir, err := os.MkdirTemp(dir, pattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("error while creating temporary directory: %w", err)
+	}
+
+	lock, err := lockDir(tempDir)
+	if err != nil {
+		os.Remove(tempDir)
+		return "", nil, fmt.Errorf("error while locking temporary directory: %w", err)
+	}
+
+	release := b.teardown.Push(fmt.Sprintf("remove '%s'", tempDir), func() error {
+		defer lock.Close()
+		return removeUnmounted(tempDir, b.loggerErr)
+	})
+
+	return tempDir, release, nil
+}
+
+// Stops the build: the signal is forwarded to the running child processes,
+// and no new ones are started.
+func (b *Builder) Interrupt(sig os.Signal) {
+	b.mu.Lock()
+	if b.interrupted != nil {
+		b.mu.Unlock()
+		fmt.Fprintf(b.loggerErr, "Received %s, already stopping\n", sig)
+		return
+	}
+	b.interrupted = sig
+
+	children := make([]*childProcess, 0, len(b.children))
+	for child := range b.children {
+		children = append(children, child)
+	}
+	b.mu.Unlock()
+
+	fmt.Fprintf(b.loggerErr, "Received %s, stopping build\n", sig)
+	for _, child := range children {
+		go child.stop(sig, ChildGracePeriod)
+	}
+}
+
+// Stops the build on SIGINT, SIGTERM, and SIGHUP. Work that does not run in
+// a child process does not notice the interrupt, so the teardown is forced
+// if the build has not stopped in time. Returns a function that ends the
+// signal handling.
+func (b *Builder) handleSignals() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		var timeout <-chan time.Time
+		for {
+			select {
+			case sig := <-signals:
+				b.Interrupt(sig)
+				if timeout == nil {
+					timeout = time.After(ChildGracePeriod + InterruptTimeout)
+				}
+			case <-timeout:
+				fmt.Fprintf(b.loggerErr, "Build did not stop in time, forcing teardown\n")
+				if err := b.teardown.Run(); err != nil {
+					fmt.Fprintf(b.loggerErr, "%s\n", err)
+				}
+				os.Exit(ExitCodeFailure)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Returns an error if the build was interrupted
+func (b *Builder) checkInterrupted() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.interrupted != nil {
+		return fmt.Errorf("build interrupted by %s", b.interrupted)
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+// rootfsbuilder - A simple tool to build Debian/Ubuntu rootfs tarballs
+// Copyright (C) 2023 Hugo Melder
+//
+// SPDX-License-Identifier: MIT
+//
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTeardownRunsInReverseOrder(t *testing.T) {
+	teardown := NewTeardown(io.Discard)
+	order := []string{}
+
+	for _, name := range []string{"tempdir", "mount", "qemu"} {
+		name := name
+		teardown.Push(name, func() error {
+			order = append(order, name)
+			return nil
+		})
+	}
+
+	if err := teardown.Run(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if strings.Join(order, ",") != "qemu,mount,tempdir" {
+		t.Errorf("expected reverse order, got: %v", order)
+	}
+
+	// Steps run only once
+	if err := teardown.Run(); err != nil || len(order) != 3 {
+		t.Errorf("expected second run to do nothing, got: %v, %v", order, err)
+	}
+}
+
+func TestTeardownRelease(t *testing.T) {
+	teardown := NewTeardown(io.Discard)
+	runs := 0
+
+	release := teardown.Push("mount", func() error {
+		runs++
+		return nil
+	})
+
+	if err := release(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := release(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err := teardown.Run(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if runs != 1 {
+		t.Errorf("expected step to run once, ran %d times", runs)
+	}
+}
+
+func TestTeardownContinuesOnError(t *testing.T) {
+	teardown := NewTeardown(io.Discard)
+	first := errors.New("umount failed")
+	ran := false
+
+	teardown.Push("remove", func() error {
+		ran = true
+		return nil
+	})
+	teardown.Push("unmount", func() error { return first })
+	teardown.Push("stop", func() error { return errors.New("kill failed") })
+
+	err := teardown.Run()
+	if !ran {
+		t.Error("expected remaining steps to run after a failure")
+	}
+	if err == nil || !strings.Contains(err.Error(), "2 teardown steps failed") {
+		t.Errorf("expected error counting failed steps, got: %v", err)
+	}
+	if errors.Is(err, first) {
+		t.Error("expected the first failing step to be 'stop'")
+	}
+}
+
+func TestChildProcessStopKillsAfterGracePeriod(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 10")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("sh not available: %s", err)
+	}
+
+	child := &childProcess{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		_ = cmd.Wait()
+		close(child.done)
+	}()
+
+	// Give the shell time to install the trap
+	time.Sleep(100 * time.Millisecond)
+
+	if err := child.stop(syscall.SIGTERM, 200*time.Millisecond); err == nil {
+		t.Error("expected error for killed process")
+	}
+
+	select {
+	case <-child.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected process to be killed")
+	}
+}
+
+func TestRunCommandAfterInterrupt(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+	builder.Interrupt(os.Interrupt)
+
+	err := builder.runCommand(exec.Command("true"))
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("expected interrupted error, got: %v", err)
+	}
+}
+
+func TestMakeTempDirRemovedOnTeardown(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	dir, _, err := builder.makeTempDir(t.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if err = builder.teardown.Run(); err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected '%s' to be removed", dir)
+	}
+}
+
+func TestMakeTempDirMovedAway(t *testing.T) {
+	builder := newTestRootfsBuilder(t)
+
+	dir, _, err := builder.makeTempDir(t.TempDir(), "rootfsbuilder-")
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	// Like a directory output with mode move
+	if err = os.Rename(dir, dir+"-output"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = builder.teardown.Run(); err != nil {
+		t.Errorf("expected no error, got: %s", err)
+	}
+}
+
+func TestCompressorStoppedOnInterrupt(t *testing.T) {
+	// A compressor that never finishes
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/xz", []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	builder := newTestRootfsBuilder(t)
+	compressor, err := builder.newCompressor(io.Discard, CompressionXz)
+	if err != nil {
+		t.Fatalf("expected no error, got: %s", err)
+	}
+	if len(builder.children) != 1 {
+		t.Fatalf("expected compressor to be a child process, got: %d", len(builder.children))
+	}
+
+	builder.Interrupt(syscall.SIGTERM)
+
+	closed := make(chan error, 1)
+	go func() { closed <- compressor.Close() }()
+	select {
+	case err = <-closed:
+		if err == nil {
+			t.Error("expected error for stopped compressor")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected compressor to be stopped")
+	}
+	if len(builder.children) != 0 {
+		t.Errorf("expected compressor to be unregistered, got: %d", len(builder.children))
+	}
+}